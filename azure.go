@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	GraphURL          = "https://graph.microsoft.com/v1.0"
+	GraphScope        = "https://graph.microsoft.com/.default"
+	AzureAuthorityURL = "https://login.microsoftonline.com"
+	graphUserType     = "#microsoft.graph.user"
+	graphGroupType    = "#microsoft.graph.group"
+)
+
+// Resolves members of Microsoft Entra ID (Azure AD) groups through the Microsoft Graph API. Groups are given by
+// object id or mail address, and nested groups are expanded by Graph itself.
+type GraphService struct {
+	Client *http.Client
+	URL    string
+	CallConfig
+}
+
+type graphDirectoryObject struct {
+	Type              string `json:"@odata.type"`
+	ID                string `json:"id"`
+	Mail              string `json:"mail"`
+	UserPrincipalName string `json:"userPrincipalName"`
+	AccountEnabled    *bool  `json:"accountEnabled"`
+}
+
+type graphPage struct {
+	Value    []graphDirectoryObject `json:"value"`
+	NextLink string                 `json:"@odata.nextLink"`
+}
+
+// Creates a Graph service authorized with the client credentials of an app registration in the given tenant.
+// The app needs the GroupMember.Read.All and User.Read.All application permissions, the latter to read whether accounts are enabled.
+func NewGraphService(tenantID, clientID, clientSecret string) *GraphService {
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", AzureAuthorityURL, url.PathEscape(tenantID))
+	return newGraphService(graphClient(tokenURL, clientID, clientSecret), GraphURL)
+}
+
+func newGraphService(client *http.Client, graphURL string) *GraphService {
+	return &GraphService{
+		Client:     client,
+		URL:        strings.TrimSuffix(graphURL, "/"),
+		CallConfig: DefaultCallConfig,
+	}
+}
+
+func graphClient(tokenURL, clientID, clientSecret string) *http.Client {
+	config := &clientcredentials.Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     tokenURL,
+		Scopes:       []string{GraphScope},
+	}
+
+	return config.Client(context.Background())
+}
+
+func (g *GraphService) String() string {
+	return fmt.Sprintf("Microsoft Graph %s", g.URL)
+}
+
+// Gets the users that are transitive members of a group, or direct members only if asked for. Nested groups with a
+// mail address are returned as groups when asked for.
+func (g *GraphService) getMembers(ctx context.Context, group string, options LookupOptions) ([]Member, error) {
+	groupID, err := g.groupID(ctx, group)
+	if err != nil {
+		promErrors.WithLabelValues("get-members").Inc()
+		return nil, fmt.Errorf("unable to get members: %w", err)
+	}
+
+	relation := "transitiveMembers"
+	if options.DirectMembersOnly || options.IncludeGroups {
+		relation = "members"
+	}
+
+	query := url.Values{"$select": {"id,mail,userPrincipalName,accountEnabled"}, "$top": {"999"}}
+	objects, err := g.list(ctx, fmt.Sprintf("%s/groups/%s/%s?%s", g.URL, url.PathEscape(groupID), relation, query.Encode()))
+	if err != nil {
+		promErrors.WithLabelValues("get-members").Inc()
+		return nil, fmt.Errorf("unable to get members: %w", groupNotFound(group, err))
+	}
+
+	var members []Member
+	var unmailed []string
+	seen := map[string]bool{}
+	for _, object := range objects {
+		if object.Type == graphGroupType && options.IncludeGroups {
+			// Groups without a mail address, e.g. security groups, can't be bound as Group subjects
+			if object.Mail == "" {
+				if !options.DirectMembersOnly {
+					unmailed = append(unmailed, object.ID)
+				}
+			} else if !seen[object.Mail] {
+				seen[object.Mail] = true
+				members = append(members, Member{Email: object.Mail, Type: MemberTypeGroup})
+			}
+			continue
+		}
+
+		members = appendUser(members, seen, object)
+	}
+
+	// Expand nested groups without a mail address to their users, so that their members keep access
+	for _, id := range unmailed {
+		objects, err := g.list(ctx, fmt.Sprintf("%s/groups/%s/transitiveMembers?%s", g.URL, url.PathEscape(id), query.Encode()))
+		if err != nil {
+			promErrors.WithLabelValues("get-members").Inc()
+			return nil, fmt.Errorf("unable to get members: nested group %s: %s", id, err)
+		}
+		for _, object := range objects {
+			members = appendUser(members, seen, object)
+		}
+	}
+
+	return members, nil
+}
+
+// Appends a directory object to the members if it is a user that is not seen yet
+func appendUser(members []Member, seen map[string]bool, object graphDirectoryObject) []Member {
+	if object.Type != graphUserType {
+		return members
+	}
+
+	email := object.Mail
+	if email == "" {
+		email = object.UserPrincipalName
+	}
+	if email == "" || seen[email] {
+		return members
+	}
+
+	status := ""
+	if object.AccountEnabled != nil {
+		status = MemberStatusSuspended
+		if *object.AccountEnabled {
+			status = MemberStatusActive
+		}
+	}
+
+	seen[email] = true
+	return append(members, Member{Email: email, Type: MemberTypeUser, Status: status})
+}
+
+// Returns the object id of a group given by mail address, or the group as is if it is not a mail address
+func (g *GraphService) groupID(ctx context.Context, group string) (string, error) {
+	if !strings.Contains(group, "@") {
+		return group, nil
+	}
+
+	query := url.Values{
+		"$filter": {fmt.Sprintf("mail eq '%s'", strings.ReplaceAll(group, "'", "''"))},
+		"$select": {"id"},
+	}
+	groups, err := g.list(ctx, fmt.Sprintf("%s/groups?%s", g.URL, query.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	switch len(groups) {
+	case 0:
+		return "", &GroupNotFoundError{Group: group}
+	case 1:
+		return groups[0].ID, nil
+	default:
+		return "", fmt.Errorf("%d groups with mail %s", len(groups), group)
+	}
+}
+
+// Lists directory objects, following next links
+func (g *GraphService) list(ctx context.Context, link string) ([]graphDirectoryObject, error) {
+	var objects []graphDirectoryObject
+	for link != "" {
+		var page graphPage
+		err := g.call(ctx, "azure-get-members", func(ctx context.Context) error {
+			return g.get(ctx, link, &page)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page.Value...)
+		link = page.NextLink
+	}
+
+	return objects, nil
+}
+
+func (g *GraphService) get(ctx context.Context, link string, page *graphPage) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+
+	response, err := g.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(response.Body)
+		return &HTTPError{StatusCode: response.StatusCode, Header: response.Header, Body: string(body)}
+	}
+
+	*page = graphPage{}
+	return json.NewDecoder(response.Body).Decode(page)
+}
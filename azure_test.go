@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Stand-in for the Microsoft Graph API and the token endpoint, serving members of groups by group id, a page at a time
+func graphHandler(groups map[string]map[string][]graphDirectoryObject, pageSize int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("scope") != GraphScope {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "graph-token", "token_type": "Bearer", "expires_in": 3600}`))
+	})
+	mux.HandleFunc("/v1.0/groups", func(w http.ResponseWriter, r *http.Request) {
+		var page graphPage
+		for id, group := range groups {
+			for _, mail := range group["mail"] {
+				if r.URL.Query().Get("$filter") == "mail eq '"+mail.Mail+"'" {
+					page.Value = append(page.Value, graphDirectoryObject{ID: id})
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+	mux.HandleFunc("/v1.0/groups/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer graph-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1.0/groups/"), "/")
+		members, ok := groups[path[0]][path[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		page := graphPage{}
+		var next string
+		if page.Value, next = testPage(members, r.URL.Query().Get("skip"), pageSize); next != "" {
+			query := r.URL.Query()
+			query.Set("skip", next)
+			page.NextLink = "http://" + r.Host + r.URL.Path + "?" + query.Encode()
+		}
+		json.NewEncoder(w).Encode(page)
+	})
+
+	return mux
+}
+
+func newTestGraphService(t *testing.T, handler http.Handler) *GraphService {
+	server := testServer(t, handler)
+
+	service := newGraphService(graphClient(server.URL+"/token", "client-id", "secret"), server.URL+"/v1.0")
+	service.Retry.BaseDelay = time.Millisecond
+	return service
+}
+
+func graphUser(mail, userPrincipalName string) graphDirectoryObject {
+	return graphDirectoryObject{Type: graphUserType, Mail: mail, UserPrincipalName: userPrincipalName}
+}
+
+func TestGraphService(t *testing.T) {
+	ctx := context.Background()
+	groups := map[string]map[string][]graphDirectoryObject{
+		"team-id": {
+			"mail": {{Mail: "team@example.com"}},
+			"members": {
+				graphUser("a@example.com", "a@tenant.onmicrosoft.com"),
+				{Type: graphGroupType, ID: "nested-id", Mail: "nested@example.com"},
+				{Type: graphGroupType, ID: "security-group-id"},
+			},
+			"transitiveMembers": {
+				graphUser("a@example.com", "a@tenant.onmicrosoft.com"),
+				{Type: "#microsoft.graph.group", ID: "nested-id"},
+				graphUser("", "b@tenant.onmicrosoft.com"),
+				{Type: "#microsoft.graph.servicePrincipal", ID: "app-id"},
+				graphUser("c@example.com", "c@tenant.onmicrosoft.com"),
+				graphUser("a@example.com", "a@tenant.onmicrosoft.com"),
+			},
+		},
+		"security-group-id": {
+			"transitiveMembers": {
+				graphUser("a@example.com", "a@tenant.onmicrosoft.com"),
+				graphUser("d@example.com", "d@tenant.onmicrosoft.com"),
+			},
+		},
+	}
+	service := newTestGraphService(t, graphHandler(groups, 2))
+
+	t.Run("transitive members of group by id, across pages", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team-id", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "b@tenant.onmicrosoft.com", "c@example.com"}, emails(members))
+	})
+
+	t.Run("group by mail address", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "b@tenant.onmicrosoft.com", "c@example.com"}, emails(members))
+	})
+
+	t.Run("account status", func(t *testing.T) {
+		enabled, disabled := true, false
+		active, suspended := graphUser("a@example.com", ""), graphUser("b@example.com", "")
+		active.AccountEnabled, suspended.AccountEnabled = &enabled, &disabled
+		service := newTestGraphService(t, graphHandler(map[string]map[string][]graphDirectoryObject{
+			"status-id": {"transitiveMembers": {active, suspended, graphUser("c@example.com", "")}},
+		}, 10))
+
+		members, err := service.getMembers(ctx, "status-id", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "a@example.com", Type: MemberTypeUser, Status: MemberStatusActive},
+			{Email: "b@example.com", Type: MemberTypeUser, Status: MemberStatusSuspended},
+			{Email: "c@example.com", Type: MemberTypeUser},
+		}, members)
+	})
+
+	t.Run("direct members only", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team-id", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com"}, emails(members))
+	})
+
+	t.Run("nested groups with mail as groups, and the users of those without", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team-id", LookupOptions{IncludeGroups: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "a@example.com", Type: MemberTypeUser},
+			{Email: "nested@example.com", Type: MemberTypeGroup},
+			{Email: "d@example.com", Type: MemberTypeUser},
+		}, members)
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		_, err := service.getMembers(ctx, "unknown@example.com", LookupOptions{})
+		assert.Error(t, err)
+		assert.True(t, isGroupNotFound(err))
+
+		_, err = service.getMembers(ctx, "unknown-id", LookupOptions{})
+		assert.Error(t, err)
+		assert.True(t, isGroupNotFound(err))
+	})
+
+	t.Run("throttled requests are retried", func(t *testing.T) {
+		graph := graphHandler(groups, 10)
+		failing, calls := failingHandler(2, http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}}, graph)
+		mux := http.NewServeMux()
+		mux.Handle("/token", graph)
+		mux.Handle("/", failing)
+		service := newTestGraphService(t, mux)
+
+		members, err := service.getMembers(ctx, "team-id", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 3)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+}
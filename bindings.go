@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const BindingsAnnotation = AnnotationNS + "/bindings"
+
+// An entry of the bindings annotation, given as a YAML or JSON list, e.g.
+//
+//   - group: team@example.com
+//     roles: [edit]
+//     prefix: team
+//   - group: auditors@example.com
+//     roles: [view]
+//     prefix: auditors
+type BindingEntry struct {
+	Group string `json:"group"`
+	// Roles to bind the members to. Defaults like the roles annotation does.
+	Roles []string `json:"roles,omitempty"`
+	// Prefix of the role binding names. Defaults like the rolebinding prefix annotation does.
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// A group to bind to roles in a namespace, with everything needed to generate its role bindings
+type Binding struct {
+	Group string
+	// Role bindings are named <prefix>-<role>
+	Prefix string
+	// Roles to bind every member to, unless MemberRoles binds members by their role in the group
+	Roles             []string
+	MemberRoles       RoleMapping
+	SubjectMode       string
+	Templates         SubjectTemplates
+	Filter            MemberFilter
+	DirectMembersOnly bool
+}
+
+// Parses the entries of the bindings annotation
+func parseBindingEntries(document string) ([]BindingEntry, error) {
+	var entries []BindingEntry
+	if err := yaml.UnmarshalStrict([]byte(document), &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse bindings: %s", err)
+	}
+
+	for i, entry := range entries {
+		if strings.TrimSpace(entry.Group) == "" {
+			return nil, fmt.Errorf("binding %d has no group", i+1)
+		}
+	}
+
+	return entries, nil
+}
+
+// Returns the groups to bind in the namespace, from the bindings annotation and the group name annotation, with the
+// settings of the other annotations of the namespace
+func (s *Synchronizer) getBindings(ns corev1.Namespace) ([]Binding, error) {
+	var entries []BindingEntry
+	if document := ns.Annotations[BindingsAnnotation]; strings.TrimSpace(document) != "" {
+		var err error
+		if entries, err = parseBindingEntries(document); err != nil {
+			promErrors.WithLabelValues("parse-bindings").Inc()
+			return nil, fmt.Errorf("invalid %s annotation: %s", BindingsAnnotation, err)
+		}
+	}
+
+	// The group name, roles and rolebinding prefix annotations are a shorthand for a single entry, where the member
+	// roles annotation replaces the roles annotation
+	if group := ns.Annotations[GroupNameAnnotation]; group != "" {
+		entry := BindingEntry{Group: group, Prefix: ns.Annotations[RolebindingPrefixAnnotation]}
+		if roles := ensureVal(ns.Annotations[RolesAnnotation], ""); roles != "" && strings.TrimSpace(ns.Annotations[MemberRolesAnnotation]) == "" {
+			entry.Roles = strings.Split(roles, ",")
+		}
+		entries = append(entries, entry)
+	}
+
+	subjectMode := ensureVal(ns.Annotations[SubjectModeAnnotation], s.SubjectMode)
+	if !isSubjectMode(subjectMode) {
+		promErrors.WithLabelValues("parse-subject-mode").Inc()
+		return nil, fmt.Errorf("invalid %s annotation: unknown subject mode %s", SubjectModeAnnotation, subjectMode)
+	}
+
+	var bindings []Binding
+	for _, entry := range entries {
+		binding := Binding{
+			Group:             entry.Group,
+			Prefix:            ensureVal(entry.Prefix, s.DefaultRoleBindingPrefix),
+			Roles:             entry.Roles,
+			SubjectMode:       subjectMode,
+			Filter:            s.MemberFilter.forNamespace(ns),
+			DirectMembersOnly: ns.Annotations[DirectMembersOnlyAnnotation] == "true",
+		}
+
+		var err error
+		if binding.Templates, err = s.subjectTemplates(ns, entry.Group); err != nil {
+			promErrors.WithLabelValues("parse-subject-template").Inc()
+			return nil, err
+		}
+
+		// Members of groups bound as they are cannot be told apart by role
+		if subjectMode != SubjectModeGroup {
+			if binding.MemberRoles, err = s.memberRoles(ns, entry.Roles); err != nil {
+				promErrors.WithLabelValues("parse-member-roles").Inc()
+				return nil, fmt.Errorf("invalid %s annotation: %s", MemberRolesAnnotation, err)
+			}
+		}
+
+		if len(binding.Roles) == 0 {
+			binding.Roles = strings.Split(s.DefaultRoles, ",")
+		}
+
+		bindings = append(bindings, binding)
+	}
+
+	return bindings, nil
+}
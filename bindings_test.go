@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseBindingEntries(t *testing.T) {
+	expected := []BindingEntry{
+		{Group: "team@example.com", Roles: []string{"edit"}, Prefix: "team"},
+		{Group: "auditors@example.com", Roles: []string{"view"}},
+	}
+
+	t.Run("yaml", func(t *testing.T) {
+		entries, err := parseBindingEntries(`
+- group: team@example.com
+  roles: [edit]
+  prefix: team
+- group: auditors@example.com
+  roles:
+  - view
+`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, entries)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		entries, err := parseBindingEntries(`[{"group": "team@example.com", "roles": ["edit"], "prefix": "team"}, {"group": "auditors@example.com", "roles": ["view"]}]`)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, entries)
+	})
+
+	t.Run("invalid entries", func(t *testing.T) {
+		for _, document := range []string{"group: team@example.com", `[{"roles": ["edit"]}]`, `[{"group": "team@example.com", "role": "edit"}]`} {
+			_, err := parseBindingEntries(document)
+			assert.Error(t, err, document)
+		}
+	})
+}
+
+func TestSynchronizerBindings(t *testing.T) {
+	ctx := context.Background()
+	synchronizer := NewSynchronizer(newFakeClientset(), &countingIAMClient{}, time.Hour, "testuser@test.domain", "testing", "view", "rbacsync")
+	namespace := func(annotations map[string]string) corev1.Namespace {
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shared", Annotations: annotations}}
+	}
+
+	t.Run("several groups with their own roles, along with the shorthand annotations", func(t *testing.T) {
+		ns := namespace(map[string]string{
+			BindingsAnnotation: `
+- group: oncall@example.com
+  roles: [edit, view]
+  prefix: oncall
+- group: auditors@example.com
+  prefix: auditors
+`,
+			GroupNameAnnotation: "team@example.com",
+			RolesAnnotation:     "admin",
+		})
+		assert.True(t, isManaged(ns))
+
+		rbs, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{ns})
+		assert.Empty(t, stale)
+		assert.Equal(t, []string{"oncall-edit", "oncall-view", "auditors-view", "rbacsync-admin"}, names(rbs))
+		assert.Equal(t, []string{"a@oncall@example.com"}, subjectNames(rbs[0].Subjects))
+		assert.Equal(t, []string{"a@auditors@example.com"}, subjectNames(rbs[2].Subjects))
+		assert.Equal(t, []string{"a@team@example.com"}, subjectNames(rbs[3].Subjects))
+	})
+
+	t.Run("roles of an entry win over the member roles annotation", func(t *testing.T) {
+		ns := namespace(map[string]string{
+			BindingsAnnotation: `
+- group: oncall@example.com
+  roles: [edit]
+  prefix: oncall
+- group: auditors@example.com
+  prefix: auditors
+`,
+			MemberRolesAnnotation: "*=view",
+			GroupNameAnnotation:   "team@example.com",
+			RolesAnnotation:       "admin",
+		})
+
+		rbs, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{ns})
+		assert.Empty(t, stale)
+		assert.Equal(t, []string{"oncall-edit", "auditors-view", "rbacsync-view"}, names(rbs), "the member roles annotation replaces the roles annotation")
+	})
+
+	t.Run("role bindings with the same name", func(t *testing.T) {
+		_, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{namespace(map[string]string{
+			BindingsAnnotation: `[{"group": "oncall@example.com"}, {"group": "auditors@example.com"}]`,
+		})})
+		assert.Equal(t, []string{"shared"}, stale)
+	})
+
+	t.Run("invalid bindings", func(t *testing.T) {
+		ns := namespace(map[string]string{BindingsAnnotation: "- roles: [view]", GroupNameAnnotation: "team@example.com"})
+		_, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{ns})
+		assert.Equal(t, []string{"shared"}, stale, "the current role bindings are kept")
+	})
+
+	t.Run("empty bindings", func(t *testing.T) {
+		assert.False(t, isManaged(namespace(map[string]string{BindingsAnnotation: " "})))
+	})
+}
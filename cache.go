@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// CachingIAMClient caches the members of each group for TTL. Concurrent lookups of the same group share a single
+// request to the underlying client. For up to MaxStale after the TTL, the cached members are returned while they are
+// refreshed in the background, and kept if the refresh fails. Groups that have not been looked up for that long are
+// evicted.
+type CachingIAMClient struct {
+	IAMClient IAMClient
+	TTL       time.Duration
+	MaxStale  time.Duration
+	// Evict groups that are not found rather than keep using their members, see Synchronizer.EmptyMissingGroups
+	EmptyMissingGroups bool
+
+	lookups singleflight.Group
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	now     func() time.Time
+}
+
+type cacheEntry struct {
+	members []Member
+	fetched time.Time
+	used    time.Time
+}
+
+func NewCachingIAMClient(iamClient IAMClient, ttl, maxStale time.Duration) *CachingIAMClient {
+	return &CachingIAMClient{
+		IAMClient: iamClient,
+		TTL:       ttl,
+		MaxStale:  maxStale,
+		entries:   make(map[string]cacheEntry),
+		now:       time.Now,
+	}
+}
+
+func (c *CachingIAMClient) String() string {
+	return fmt.Sprintf("ttl: %s, max stale: %s", c.TTL, c.MaxStale)
+}
+
+func (c *CachingIAMClient) getMembers(ctx context.Context, groupEmail string, options LookupOptions) ([]Member, error) {
+	key := fmt.Sprintf("%s/%t/%t", strings.ToLower(groupEmail), options.DirectMembersOnly, options.IncludeGroups)
+
+	entry, found := c.get(key)
+	age := c.now().Sub(entry.fetched)
+	switch {
+	case found && age < c.TTL:
+		promCacheLookups.WithLabelValues("hit").Inc()
+		return entry.members, nil
+	case found && age < c.TTL+c.MaxStale:
+		promCacheLookups.WithLabelValues("stale").Inc()
+		// The refresh outlives the synchronization that started it, and is bounded by the timeouts of the client
+		c.lookups.DoChan(key, func() (interface{}, error) {
+			members, err := c.refresh(context.Background(), key, groupEmail, options)
+			if err != nil {
+				log.Warnf("unable to refresh members of group %s, using members from %s: %s", groupEmail, entry.fetched.Format(time.RFC3339), err)
+			}
+			return members, err
+		})
+		return entry.members, nil
+	}
+
+	promCacheLookups.WithLabelValues("miss").Inc()
+	members, err, _ := c.lookups.Do(key, func() (interface{}, error) {
+		return c.refresh(ctx, key, groupEmail, options)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return members.([]Member), nil
+}
+
+// Fetches the members of a group into the cache. If that fails, cached members are kept until they expire, unless
+// the group no longer exists and missing groups are emptied.
+func (c *CachingIAMClient) refresh(ctx context.Context, key, groupEmail string, options LookupOptions) ([]Member, error) {
+	members, err := c.IAMClient.getMembers(ctx, groupEmail, options)
+	if isGroupNotFound(err) && c.EmptyMissingGroups {
+		c.evict(key)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.set(key, members)
+	return members, nil
+}
+
+func (c *CachingIAMClient) get(key string) (cacheEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, found := c.entries[key]
+	if found {
+		entry.used = c.now()
+		c.entries[key] = entry
+	}
+	return entry, found
+}
+
+// Caches the members of a group, and evicts the groups that have not been looked up for longer than they can be used
+func (c *CachingIAMClient) set(key string, members []Member) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	for cached, entry := range c.entries {
+		if now.Sub(entry.used) >= c.TTL+c.MaxStale {
+			delete(c.entries, cached)
+		}
+	}
+
+	c.entries[key] = cacheEntry{members: members, fetched: now, used: now}
+}
+
+func (c *CachingIAMClient) evict(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.entries, key)
+}
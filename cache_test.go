@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Counts lookups and blocks each of them until release is closed
+type countingIAMClient struct {
+	lookups atomic.Int32
+	release chan struct{}
+	err     error
+}
+
+func (c *countingIAMClient) getMembers(_ context.Context, groupEmail string, _ LookupOptions) ([]Member, error) {
+	c.lookups.Add(1)
+	if c.release != nil {
+		<-c.release
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return []Member{user("a@"+groupEmail, "")}, nil
+}
+
+func TestCachingIAMClient(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now()
+	// Background refreshes read the clock, so it is moved forward rather than replaced
+	newCache := func(client IAMClient) (*CachingIAMClient, func(time.Duration)) {
+		var elapsed atomic.Int64
+		cache := NewCachingIAMClient(client, time.Minute, time.Hour)
+		cache.now = func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+		return cache, func(d time.Duration) { elapsed.Store(int64(d)) }
+	}
+	cached := func(cache *CachingIAMClient) int {
+		cache.lock.Lock()
+		defer cache.lock.Unlock()
+		return len(cache.entries)
+	}
+
+	t.Run("caches members until ttl has passed", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, _ := newCache(client)
+
+		for i := 0; i < 3; i++ {
+			members, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"a@team@acme.no"}, emails(members))
+		}
+		assert.Equal(t, int32(1), client.lookups.Load())
+	})
+
+	t.Run("returns expired members while refreshing them in the background", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, setElapsed := newCache(client)
+
+		_, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+
+		client.release = make(chan struct{})
+		setElapsed(2 * time.Minute)
+		members, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err, "does not wait for the refresh")
+		assert.Equal(t, []string{"a@team@acme.no"}, emails(members))
+
+		assert.Eventually(t, func() bool { return client.lookups.Load() == 2 }, time.Second, time.Millisecond)
+		close(client.release)
+		assert.Eventually(t, func() bool {
+			entry, _ := cache.get("team@acme.no/false/false")
+			return entry.fetched.Equal(start.Add(2 * time.Minute))
+		}, time.Second, time.Millisecond)
+
+		_, err = cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, int32(2), client.lookups.Load(), "refreshed members are fresh")
+	})
+
+	t.Run("caches groups and options separately", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, _ := newCache(client)
+
+		cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		cache.getMembers(ctx, "TEAM@acme.no", LookupOptions{})
+		cache.getMembers(ctx, "team@acme.no", LookupOptions{DirectMembersOnly: true})
+		cache.getMembers(ctx, "other@acme.no", LookupOptions{})
+		assert.Equal(t, int32(3), client.lookups.Load())
+	})
+
+	t.Run("shares concurrent lookups of the same group", func(t *testing.T) {
+		client := &countingIAMClient{release: make(chan struct{})}
+		cache, _ := newCache(client)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				members, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+				assert.NoError(t, err)
+				assert.Len(t, members, 1)
+			}()
+		}
+
+		assert.Eventually(t, func() bool { return client.lookups.Load() == 1 }, time.Second, time.Millisecond)
+		time.Sleep(10 * time.Millisecond)
+		close(client.release)
+		wg.Wait()
+		assert.Equal(t, int32(1), client.lookups.Load())
+	})
+
+	t.Run("keeps stale members when refreshing fails", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, setElapsed := newCache(client)
+
+		_, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+
+		client.err = fmt.Errorf("rate limited")
+		setElapsed(30 * time.Minute)
+		members, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@team@acme.no"}, emails(members))
+		assert.Eventually(t, func() bool { return client.lookups.Load() == 2 }, time.Second, time.Millisecond)
+
+		setElapsed(2 * time.Hour)
+		_, err = cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("keeps stale members of a group that is not found", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, setElapsed := newCache(client)
+
+		_, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+
+		client.err = &GroupNotFoundError{Group: "team@acme.no"}
+		setElapsed(30 * time.Minute)
+		_, err = cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return client.lookups.Load() == 2 }, time.Second, time.Millisecond)
+		assert.Equal(t, 1, cached(cache))
+	})
+
+	t.Run("does not use stale members of a group that no longer exists when missing groups are emptied", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, setElapsed := newCache(client)
+		cache.EmptyMissingGroups = true
+
+		_, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+
+		client.err = &GroupNotFoundError{Group: "team@acme.no"}
+		setElapsed(30 * time.Minute)
+		_, err = cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Eventually(t, func() bool { return cached(cache) == 0 }, time.Second, time.Millisecond)
+
+		_, err = cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.True(t, isGroupNotFound(err))
+	})
+
+	t.Run("evicts groups that are no longer looked up", func(t *testing.T) {
+		client := &countingIAMClient{}
+		cache, setElapsed := newCache(client)
+
+		cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		cache.getMembers(ctx, "other@acme.no", LookupOptions{})
+		setElapsed(30 * time.Minute)
+		cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.Eventually(t, func() bool { return client.lookups.Load() == 3 }, time.Second, time.Millisecond)
+
+		setElapsed(90 * time.Minute)
+		cache.getMembers(ctx, "new@acme.no", LookupOptions{})
+		assert.Equal(t, 2, cached(cache), "other@acme.no has not been looked up for ttl and max stale")
+	})
+
+	t.Run("fails when group has never been fetched", func(t *testing.T) {
+		cache, _ := newCache(&countingIAMClient{err: fmt.Errorf("rate limited")})
+
+		_, err := cache.getMembers(ctx, "team@acme.no", LookupOptions{})
+		assert.Error(t, err)
+	})
+}
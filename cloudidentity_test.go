@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/cloudidentity/v1"
+	"google.golang.org/api/option"
+)
+
+// Stand-in for the Cloud Identity Groups API, serving the transitive memberships of groups by e-mail, a page at a time
+func cloudIdentityHandler(groups map[string][]*cloudidentity.MemberRelation, pageSize int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/groups:lookup", func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Query().Get("groupKey.id")
+		if _, ok := groups[email]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(cloudidentity.LookupGroupNameResponse{Name: "groups/" + email})
+	})
+	mux.HandleFunc("/v1/groups/", func(w http.ResponseWriter, r *http.Request) {
+		email := r.URL.Path[len("/v1/groups/") : len(r.URL.Path)-len("/memberships:searchTransitiveMemberships")]
+		memberships := groups[email]
+
+		page := cloudidentity.SearchTransitiveMembershipsResponse{}
+		page.Memberships, page.NextPageToken = testPage(memberships, r.URL.Query().Get("pageToken"), pageSize)
+		json.NewEncoder(w).Encode(page)
+	})
+
+	return mux
+}
+
+func newTestCloudIdentityService(t *testing.T, handler http.Handler) *CloudIdentityService {
+	server := testServer(t, handler)
+
+	service, err := cloudidentity.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	retry := DefaultRetryConfig
+	retry.BaseDelay = time.Millisecond
+	return &CloudIdentityService{Service: service, CallConfig: CallConfig{Retry: retry}}
+}
+
+func memberRelation(member, email, relationType string) *cloudidentity.MemberRelation {
+	return &cloudidentity.MemberRelation{
+		Member:             member,
+		PreferredMemberKey: []*cloudidentity.EntityKey{{Id: email}},
+		RelationType:       relationType,
+	}
+}
+
+func TestCloudIdentityService(t *testing.T) {
+	ctx := context.Background()
+	groups := map[string][]*cloudidentity.MemberRelation{
+		"team@example.com": {
+			memberRelation("users/1", "a@example.com", cloudIdentityDirect),
+			memberRelation("groups/2", "nested@example.com", cloudIdentityDirect),
+			memberRelation("users/3", "b@example.com", "INDIRECT"),
+			memberRelation("users/4", "c@example.com", cloudIdentityDirectAndIndirect),
+		},
+	}
+	service := newTestCloudIdentityService(t, cloudIdentityHandler(groups, 2))
+
+	t.Run("transitive members across pages, without groups", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "b@example.com", "c@example.com"}, emails(members))
+	})
+
+	t.Run("highest role of each member", func(t *testing.T) {
+		owner := memberRelation("users/5", "owner@example.com", cloudIdentityDirect)
+		owner.Roles = []*cloudidentity.TransitiveMembershipRole{{Role: MemberRoleMember}, {Role: MemberRoleOwner}}
+		service := newTestCloudIdentityService(t, cloudIdentityHandler(map[string][]*cloudidentity.MemberRelation{
+			"roles@example.com": {owner, memberRelation("users/6", "unknown@example.com", cloudIdentityDirect)},
+		}, 10))
+
+		members, err := service.getMembers(ctx, "roles@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "owner@example.com", Type: MemberTypeUser, Role: MemberRoleOwner},
+			{Email: "unknown@example.com", Type: MemberTypeUser},
+		}, members)
+	})
+
+	t.Run("direct members only", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "c@example.com"}, emails(members))
+	})
+
+	t.Run("nested groups as groups, with direct users", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{IncludeGroups: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "a@example.com", Type: MemberTypeUser},
+			{Email: "nested@example.com", Type: MemberTypeGroup},
+			{Email: "c@example.com", Type: MemberTypeUser},
+		}, members)
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		_, err := service.getMembers(ctx, "unknown@example.com", LookupOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("server errors are retried", func(t *testing.T) {
+		handler, requests := failingHandler(1, http.StatusServiceUnavailable, nil, cloudIdentityHandler(groups, 10))
+		service := newTestCloudIdentityService(t, handler)
+
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 3)
+		assert.Equal(t, int32(3), requests.Load())
+	})
+}
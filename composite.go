@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Routes groups to IAM clients by a provider prefix, e.g. google:team@example.com, azure:<object-id> or file:ops.
+// Groups without the prefix of a configured provider go to the default provider, so existing annotations keep working.
+type CompositeIAMClient struct {
+	Backends map[string]IAMClient
+	Default  string
+}
+
+func NewCompositeIAMClient(defaultProvider string) *CompositeIAMClient {
+	return &CompositeIAMClient{Backends: map[string]IAMClient{}, Default: defaultProvider}
+}
+
+func (c *CompositeIAMClient) String() string {
+	var providers []string
+	for provider := range c.Backends {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+
+	return fmt.Sprintf("providers: %s (default: %s)", strings.Join(providers, ", "), c.Default)
+}
+
+// Gets the members of a group from the provider it is routed to
+func (c *CompositeIAMClient) getMembers(ctx context.Context, group string, options LookupOptions) ([]Member, error) {
+	provider, name := c.route(group)
+	backend, ok := c.Backends[provider]
+	if !ok {
+		promProviderLookups.WithLabelValues(provider, "error").Inc()
+		return nil, fmt.Errorf("no %s provider configured for group %s", provider, group)
+	}
+
+	members, err := backend.getMembers(ctx, name, options)
+	if err != nil {
+		promProviderLookups.WithLabelValues(provider, "error").Inc()
+		return nil, fmt.Errorf("%s provider: %w", provider, err)
+	}
+
+	promProviderLookups.WithLabelValues(provider, "success").Inc()
+	return members, nil
+}
+
+// Returns the provider and the group name without prefix. Only provider names are taken as prefixes, so a group
+// containing a colon for other reasons goes to the default provider as it is.
+func (c *CompositeIAMClient) route(group string) (string, string) {
+	if provider, name := splitProvider(group); provider != "" {
+		return provider, name
+	}
+
+	return c.Default, group
+}
+
+// Splits a provider prefix off the group name, returning an empty provider if there is none
+func splitProvider(group string) (string, string) {
+	if provider, name, ok := strings.Cut(group, ":"); ok && isProvider(provider) {
+		return provider, name
+	}
+
+	return "", group
+}
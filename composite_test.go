@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompositeIAMClient(t *testing.T) {
+	ctx := context.Background()
+	google := &countingIAMClient{}
+	azure := &countingIAMClient{err: fmt.Errorf("throttled")}
+	composite := NewCompositeIAMClient(ProviderGoogle)
+	composite.Backends[ProviderGoogle] = google
+	composite.Backends[ProviderAzure] = azure
+	composite.Backends[ProviderFile], _ = newFileService(ctx, "test", func(context.Context) ([]byte, error) {
+		return []byte("groups: {ops: {members: [ops@example.com]}}"), nil
+	})
+
+	t.Run("groups without prefix go to the default provider", func(t *testing.T) {
+		members, err := composite.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@team@example.com"}, emails(members))
+	})
+
+	t.Run("groups are routed by prefix", func(t *testing.T) {
+		members, err := composite.getMembers(ctx, "google:team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@team@example.com"}, emails(members))
+
+		members, err = composite.getMembers(ctx, "file:ops", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ops@example.com"}, emails(members))
+		assert.Equal(t, int32(2), google.lookups.Load())
+	})
+
+	t.Run("errors are labelled by provider", func(t *testing.T) {
+		before := testutil.ToFloat64(promProviderLookups.WithLabelValues(ProviderAzure, "error"))
+		_, err := composite.getMembers(ctx, "azure:0b6e2a4c-object-id", LookupOptions{})
+		assert.EqualError(t, err, "azure provider: throttled")
+		assert.Equal(t, before+1, testutil.ToFloat64(promProviderLookups.WithLabelValues(ProviderAzure, "error")))
+	})
+
+	t.Run("retries are labelled by provider", func(t *testing.T) {
+		handler, _ := failingHandler(1, http.StatusServiceUnavailable, nil, gitHubHandler(map[string]map[string][]GitHubUser{
+			"nais/team": {gitHubMembershipAll: {{Login: "alice"}}},
+		}, 10))
+		github := newTestGitHubService(t, handler)
+		github.Retry = RetryConfig{MaxRetries: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+		composite.Backends[ProviderGitHub] = github
+		defer delete(composite.Backends, ProviderGitHub)
+
+		before := testutil.ToFloat64(promRetries.WithLabelValues("github-get-members"))
+		beforeGoogle := testutil.ToFloat64(promRetries.WithLabelValues("google-get-members"))
+		_, err := composite.getMembers(ctx, "github:nais/team", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, before+1, testutil.ToFloat64(promRetries.WithLabelValues("github-get-members")))
+		assert.Equal(t, beforeGoogle, testutil.ToFloat64(promRetries.WithLabelValues("google-get-members")))
+	})
+
+	t.Run("provider that is not configured", func(t *testing.T) {
+		_, err := composite.getMembers(ctx, "github:nais/team", LookupOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("colon that is not a provider prefix", func(t *testing.T) {
+		assert.Equal(t, []string{ProviderGoogle, "cn=a:b,dc=example"}, route(composite, "cn=a:b,dc=example"))
+		assert.Equal(t, []string{ProviderLDAP, "cn=a:b,dc=example"}, route(composite, "ldap:cn=a:b,dc=example"))
+	})
+}
+
+func route(c *CompositeIAMClient, group string) []string {
+	provider, name := c.route(group)
+	return []string{provider, name}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// KeyFileCredentials is a token source for a service account key file, acting on behalf of Subject if set. The key
+// file can be reloaded while in use, and a new key only replaces the current one once it has been used to get a token.
+type KeyFileCredentials struct {
+	KeyFile string
+	Subject string
+	Scopes  []string
+
+	lock   sync.RWMutex
+	key    []byte
+	source oauth2.TokenSource
+}
+
+func NewKeyFileCredentials(keyFile, subject string, scopes ...string) (*KeyFileCredentials, error) {
+	credentials := &KeyFileCredentials{KeyFile: keyFile, Subject: subject, Scopes: scopes}
+
+	key, source, err := credentials.read(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	credentials.key = key
+	credentials.source = source
+	return credentials, nil
+}
+
+func (c *KeyFileCredentials) Token() (*oauth2.Token, error) {
+	c.lock.RLock()
+	source := c.source
+	c.lock.RUnlock()
+
+	return source.Token()
+}
+
+// Reloads the key file every interval until ctx is done
+func (c *KeyFileCredentials) watch(ctx context.Context, interval time.Duration) {
+	log.Infof("reloading service account key file %s every %s", c.KeyFile, interval)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := c.reload(ctx); err != nil {
+			promCredentialReloads.WithLabelValues("failure").Inc()
+			log.Errorf("unable to reload service account key file, keeping current key: %s", err)
+		}
+	}, interval)
+}
+
+// Replaces the current key if the key file has changed and the new key can be used to get a token
+func (c *KeyFileCredentials) reload(ctx context.Context) error {
+	key, source, err := c.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	c.lock.RLock()
+	unchanged := bytes.Equal(key, c.key)
+	c.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	if _, err := source.Token(); err != nil {
+		return fmt.Errorf("unable to get token with new key: %s", err)
+	}
+
+	c.lock.Lock()
+	c.key = key
+	c.source = source
+	c.lock.Unlock()
+
+	promCredentialReloads.WithLabelValues("success").Inc()
+	log.Infof("reloaded service account key file %s", c.KeyFile)
+	return nil
+}
+
+func (c *KeyFileCredentials) read(ctx context.Context) ([]byte, oauth2.TokenSource, error) {
+	key, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read service account key file %s", err)
+	}
+
+	config, err := google.JWTConfigFromJSON(key, c.Scopes...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse service account key file to config: %s", err)
+	}
+
+	config.Subject = c.Subject
+	return key, config.TokenSource(ctx), nil
+}
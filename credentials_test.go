@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	admin "google.golang.org/api/admin/directory/v1"
+)
+
+// Writes a service account key file with the given key id, getting tokens from tokenURL
+func writeKeyFile(t *testing.T, path, keyID, tokenURL string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	keyFile, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "rbac-sync@project.iam.gserviceaccount.com",
+		"private_key_id": keyID,
+		"private_key":    string(privateKey),
+		"token_uri":      tokenURL,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, keyFile, 0600))
+}
+
+// Issues the key id of the assertion as access token, unless the key id is "revoked"
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(r.Form.Get("assertion"), ".")[0])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var jwtHeader struct {
+		KeyID string `json:"kid"`
+	}
+	json.Unmarshal(header, &jwtHeader)
+	if jwtHeader.KeyID == "revoked" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": jwtHeader.KeyID, "token_type": "Bearer", "expires_in": 3600})
+}
+
+func TestKeyFileCredentials(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(tokenHandler))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	writeKeyFile(t, path, "first", server.URL)
+
+	credentials, err := NewKeyFileCredentials(path, "admin@example.com", admin.AdminDirectoryGroupReadonlyScope)
+	assert.NoError(t, err)
+
+	token, err := credentials.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "first", token.AccessToken)
+
+	t.Run("unchanged key file keeps current key", func(t *testing.T) {
+		assert.NoError(t, credentials.reload(ctx))
+
+		token, err := credentials.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "first", token.AccessToken)
+	})
+
+	t.Run("new key replaces current key", func(t *testing.T) {
+		writeKeyFile(t, path, "second", server.URL)
+		assert.NoError(t, credentials.reload(ctx))
+
+		token, err := credentials.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "second", token.AccessToken)
+	})
+
+	t.Run("unusable key keeps current key", func(t *testing.T) {
+		writeKeyFile(t, path, "revoked", server.URL)
+		assert.Error(t, credentials.reload(ctx))
+
+		token, err := credentials.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "second", token.AccessToken)
+	})
+
+	t.Run("invalid key file keeps current key", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0600))
+		assert.Error(t, credentials.reload(ctx))
+
+		token, err := credentials.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "second", token.AccessToken)
+	})
+}
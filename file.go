@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const DefaultGroupsConfigMapKey = "groups.yaml"
+
+// Groups as read from YAML, e.g.
+//
+//	groups:
+//	  team@example.com:
+//	    members: [alice@example.com]
+//	    groups: [platform@example.com]
+type StaticGroups struct {
+	Groups map[string]StaticGroup `json:"groups"`
+}
+
+type StaticGroup struct {
+	Members []string `json:"members"`
+	// Names of nested groups, whose members are members of this group too
+	Groups []string `json:"groups"`
+}
+
+// Resolves group members from a YAML document, read from a file or a ConfigMap and reloaded when it changes.
+// Group names are case insensitive.
+type FileService struct {
+	// Maximum number of levels of nested groups to expand
+	MaxDepth int
+
+	source   string
+	read     func(ctx context.Context) ([]byte, error)
+	lock     sync.RWMutex
+	document []byte
+	groups   map[string]StaticGroup
+}
+
+// Creates a file service reading groups from a YAML file, e.g. a ConfigMap mounted as a volume
+func NewFileService(ctx context.Context, path string) (*FileService, error) {
+	return newFileService(ctx, path, func(context.Context) ([]byte, error) {
+		return ioutil.ReadFile(path)
+	})
+}
+
+// Creates a file service reading groups from the given key of a ConfigMap
+func NewConfigMapFileService(ctx context.Context, clientSet kubernetes.Interface, namespace, name, key string) (*FileService, error) {
+	return newFileService(ctx, fmt.Sprintf("configmap %s/%s (%s)", namespace, name, key), func(ctx context.Context) ([]byte, error) {
+		configMap, err := clientSet.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		document, ok := configMap.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("no key %s in configmap %s/%s", key, namespace, name)
+		}
+		return []byte(document), nil
+	})
+}
+
+func newFileService(ctx context.Context, source string, read func(ctx context.Context) ([]byte, error)) (*FileService, error) {
+	f := &FileService{MaxDepth: DefaultMaxGroupDepth, source: source, read: read}
+	if err := f.reload(ctx); err != nil {
+		promErrors.WithLabelValues("load-groups").Inc()
+		return nil, fmt.Errorf("unable to load groups from %s: %s", source, err)
+	}
+
+	return f, nil
+}
+
+func (f *FileService) String() string {
+	return fmt.Sprintf("groups from %s", f.source)
+}
+
+// Reloads the groups every interval until ctx is done
+func (f *FileService) watch(ctx context.Context, interval time.Duration) {
+	log.Infof("reloading %s every %s", f, interval)
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := f.reload(ctx); err != nil {
+			promErrors.WithLabelValues("load-groups").Inc()
+			log.Errorf("unable to reload %s, keeping current groups: %s", f, err)
+		}
+	}, interval)
+}
+
+// Replaces the current groups if the document has changed and is valid
+func (f *FileService) reload(ctx context.Context) error {
+	document, err := f.read(ctx)
+	if err != nil {
+		return err
+	}
+
+	f.lock.RLock()
+	unchanged := f.groups != nil && bytes.Equal(document, f.document)
+	f.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	groups, err := parseStaticGroups(document)
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	f.document = document
+	f.groups = groups
+	f.lock.Unlock()
+
+	log.Infof("loaded %d groups from %s", len(groups), f.source)
+	return nil
+}
+
+// Parses groups from YAML, keyed by lower case name
+func parseStaticGroups(document []byte) (map[string]StaticGroup, error) {
+	var static StaticGroups
+	if err := yaml.UnmarshalStrict(document, &static); err != nil {
+		return nil, fmt.Errorf("unable to parse groups: %s", err)
+	}
+
+	groups := map[string]StaticGroup{}
+	for name, group := range static.Groups {
+		key := strings.ToLower(name)
+		if _, ok := groups[key]; ok {
+			return nil, fmt.Errorf("group %s is defined more than once", name)
+		}
+		groups[key] = group
+	}
+
+	return groups, nil
+}
+
+// Gets group members by name, expanding nested groups until MaxDepth
+func (f *FileService) getMembers(ctx context.Context, group string, options LookupOptions) ([]Member, error) {
+	f.lock.RLock()
+	groups := f.groups
+	f.lock.RUnlock()
+
+	members, err := expandGroup(ctx, group, f.MaxDepth, options, func(_ context.Context, name string) ([]Member, error) {
+		group, ok := groups[strings.ToLower(name)]
+		if !ok {
+			return nil, &GroupNotFoundError{Group: fmt.Sprintf("%s in %s", name, f.source)}
+		}
+
+		var members []Member
+		for _, member := range group.Members {
+			members = append(members, user(member, ""))
+		}
+		for _, nested := range group.Groups {
+			members = append(members, Member{Email: nested, Type: MemberTypeGroup})
+		}
+		return members, nil
+	})
+	if err != nil {
+		promErrors.WithLabelValues("get-members").Inc()
+		return nil, fmt.Errorf("unable to get members: %w", err)
+	}
+
+	return members, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testGroups = `
+groups:
+  Team@example.com:
+    members: [a@example.com, b@example.com]
+    groups: [platform@example.com]
+  platform@example.com:
+    members: [b@example.com, c@example.com]
+    groups: [ops@example.com]
+  ops@example.com:
+    members: [d@example.com]
+    groups: [team@example.com]
+`
+
+func TestFileService(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "groups.yaml")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testGroups), 0600))
+
+	service, err := NewFileService(ctx, path)
+	assert.NoError(t, err)
+
+	t.Run("members of nested groups, skipping cycles", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}, emails(members))
+	})
+
+	t.Run("direct members only", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "TEAM@example.com", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "b@example.com"}, emails(members))
+	})
+
+	t.Run("nested groups as groups", func(t *testing.T) {
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{IncludeGroups: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "a@example.com", Type: MemberTypeUser},
+			{Email: "b@example.com", Type: MemberTypeUser},
+			{Email: "platform@example.com", Type: MemberTypeGroup},
+		}, members)
+	})
+
+	t.Run("max depth", func(t *testing.T) {
+		shallow := &FileService{MaxDepth: 1, groups: service.groups}
+		_, err := shallow.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		_, err := service.getMembers(ctx, "unknown@example.com", LookupOptions{})
+		assert.Error(t, err)
+		assert.True(t, isGroupNotFound(err))
+	})
+
+	t.Run("reloads changed file", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte("groups: {team@example.com: {members: [e@example.com]}}"), 0600))
+		assert.NoError(t, service.reload(ctx))
+
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"e@example.com"}, emails(members))
+	})
+
+	t.Run("invalid file keeps current groups", func(t *testing.T) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte("groups: {team@example.com: {users: [f@example.com]}}"), 0600))
+		assert.Error(t, service.reload(ctx))
+
+		members, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"e@example.com"}, emails(members))
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := NewFileService(ctx, filepath.Join(t.TempDir(), "missing.yaml"))
+		assert.Error(t, err)
+	})
+}
+
+func TestConfigMapFileService(t *testing.T) {
+	ctx := context.Background()
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "rbac-sync", Name: "groups"},
+		Data:       map[string]string{DefaultGroupsConfigMapKey: testGroups},
+	}
+	clientSet := fake.NewSimpleClientset(configMap)
+
+	service, err := NewConfigMapFileService(ctx, clientSet, "rbac-sync", "groups", DefaultGroupsConfigMapKey)
+	assert.NoError(t, err)
+
+	members, err := service.getMembers(ctx, "ops@example.com", LookupOptions{DirectMembersOnly: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d@example.com"}, emails(members))
+
+	configMap.Data[DefaultGroupsConfigMapKey] = "groups: {ops@example.com: {members: [e@example.com]}}"
+	_, err = clientSet.CoreV1().ConfigMaps("rbac-sync").Update(ctx, configMap, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, service.reload(ctx))
+
+	members, err = service.getMembers(ctx, "ops@example.com", LookupOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"e@example.com"}, emails(members))
+
+	_, err = NewConfigMapFileService(ctx, clientSet, "rbac-sync", "groups", "missing.yaml")
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	MemberStatusesAnnotation = AnnotationNS + "/member-statuses"
+	MemberTypesAnnotation    = AnnotationNS + "/member-types"
+	MemberDomainsAnnotation  = AnnotationNS + "/member-domains"
+	FilterReasonStatus       = "status"
+	FilterReasonType         = "type"
+	FilterReasonDomain       = "domain"
+)
+
+// Decides which group members become role binding subjects. An empty list allows anything.
+type MemberFilter struct {
+	// Member statuses to keep, e.g. ACTIVE. Members whose status the provider does not know are always kept.
+	Statuses []string
+	// Member types to keep, e.g. USER and SERVICE_ACCOUNT. Groups kept as Group subjects are not filtered by type.
+	Types []string
+	// E-mail domains to keep, e.g. example.com
+	Domains []string
+}
+
+// Parses a filter from comma-separated lists of statuses, types and domains
+func NewMemberFilter(statuses, types, domains string) MemberFilter {
+	return MemberFilter{
+		Statuses: splitList(statuses),
+		Types:    splitList(types),
+		Domains:  splitList(domains),
+	}
+}
+
+func (f MemberFilter) String() string {
+	return fmt.Sprintf("statuses: %s, types: %s, domains: %s", describeList(f.Statuses), describeList(f.Types), describeList(f.Domains))
+}
+
+// Returns the filter with the lists given by annotations on the namespace replacing the global ones
+func (f MemberFilter) forNamespace(namespace corev1.Namespace) MemberFilter {
+	if statuses, ok := namespace.Annotations[MemberStatusesAnnotation]; ok {
+		f.Statuses = splitList(statuses)
+	}
+	if types, ok := namespace.Annotations[MemberTypesAnnotation]; ok {
+		f.Types = splitList(types)
+	}
+	if domains, ok := namespace.Annotations[MemberDomainsAnnotation]; ok {
+		f.Domains = splitList(domains)
+	}
+	return f
+}
+
+// Returns the members that pass the filter, and the number of members dropped by reason
+func (f MemberFilter) apply(members []Member) (kept []Member, dropped map[string]int) {
+	dropped = map[string]int{FilterReasonStatus: 0, FilterReasonType: 0, FilterReasonDomain: 0}
+	for _, member := range members {
+		if reason := f.reject(member); reason != "" {
+			dropped[reason]++
+			continue
+		}
+		kept = append(kept, member)
+	}
+	return
+}
+
+// Returns why the member is filtered out, or an empty string if it is kept
+func (f MemberFilter) reject(member Member) string {
+	if member.Status != "" && len(f.Statuses) > 0 && !containsFold(f.Statuses, member.Status) {
+		return FilterReasonStatus
+	}
+	if len(f.Types) > 0 && member.Type != MemberTypeGroup && !containsFold(f.Types, member.Type) {
+		return FilterReasonType
+	}
+	if len(f.Domains) > 0 && !containsFold(f.Domains, domain(member.Email)) {
+		return FilterReasonDomain
+	}
+	return ""
+}
+
+func domain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
+
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func describeList(list []string) string {
+	if len(list) == 0 {
+		return "any"
+	}
+	return strings.Join(list, ",")
+}
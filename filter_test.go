@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMemberFilter(t *testing.T) {
+	members := []Member{
+		user("active@example.com", MemberStatusActive),
+		user("suspended@example.com", MemberStatusSuspended),
+		user("unknown@example.com", ""),
+		user("robot@project.iam.gserviceaccount.com", MemberStatusActive),
+		{Email: "customer@example.com", Type: "CUSTOMER", Status: MemberStatusActive},
+		user("external@Partner.example", MemberStatusActive),
+	}
+
+	t.Run("empty filter keeps everyone", func(t *testing.T) {
+		kept, dropped := NewMemberFilter("", "", "").apply(members)
+		assert.Equal(t, members, kept)
+		assert.Equal(t, map[string]int{FilterReasonStatus: 0, FilterReasonType: 0, FilterReasonDomain: 0}, dropped)
+	})
+
+	t.Run("status, keeping members of unknown status", func(t *testing.T) {
+		kept, dropped := NewMemberFilter("ACTIVE", "", "").apply(members)
+		assert.NotContains(t, emails(kept), "suspended@example.com")
+		assert.Contains(t, emails(kept), "unknown@example.com")
+		assert.Equal(t, 1, dropped[FilterReasonStatus])
+	})
+
+	t.Run("type", func(t *testing.T) {
+		kept, dropped := NewMemberFilter("", "user, service_account", "").apply(members)
+		assert.Contains(t, emails(kept), "robot@project.iam.gserviceaccount.com")
+		assert.NotContains(t, emails(kept), "customer@example.com")
+		assert.Equal(t, 1, dropped[FilterReasonType])
+
+		kept, _ = NewMemberFilter("", "USER", "").apply(members)
+		assert.NotContains(t, emails(kept), "robot@project.iam.gserviceaccount.com")
+	})
+
+	t.Run("domain, case insensitive", func(t *testing.T) {
+		kept, dropped := NewMemberFilter("", "", "partner.example").apply(members)
+		assert.Equal(t, []string{"external@Partner.example"}, emails(kept))
+		assert.Equal(t, 5, dropped[FilterReasonDomain])
+	})
+
+	t.Run("members are counted once, by the first reason", func(t *testing.T) {
+		kept, dropped := NewMemberFilter("ACTIVE", "USER", "example.com").apply(members)
+		assert.Equal(t, []string{"active@example.com", "unknown@example.com"}, emails(kept))
+		assert.Equal(t, map[string]int{FilterReasonStatus: 1, FilterReasonType: 2, FilterReasonDomain: 1}, dropped)
+	})
+}
+
+func TestMemberFilterForNamespace(t *testing.T) {
+	global := NewMemberFilter("ACTIVE", "USER", "example.com")
+	namespace := func(annotations map[string]string) corev1.Namespace {
+		return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}}
+	}
+
+	assert.Equal(t, global, global.forNamespace(namespace(nil)))
+	assert.Equal(t, MemberFilter{Statuses: []string{"ACTIVE"}, Types: []string{"USER", "SERVICE_ACCOUNT"}, Domains: []string{"example.com"}},
+		global.forNamespace(namespace(map[string]string{MemberTypesAnnotation: "USER,SERVICE_ACCOUNT"})))
+	assert.Equal(t, MemberFilter{Statuses: []string{"ACTIVE"}, Types: []string{"USER"}},
+		global.forNamespace(namespace(map[string]string{MemberDomainsAnnotation: ""})), "empty annotation allows any domain")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	GitHubURL                  = "https://api.github.com"
+	gitHubMembershipAll        = "ALL"
+	gitHubMembershipImmediate  = "IMMEDIATE"
+	gitHubRateLimitedErrorType = "RATE_LIMITED"
+	gitHubTeamMembersQuery     = `query($org: String!, $team: String!, $membership: TeamMembershipType!, $cursor: String) {
+  organization(login: $org) {
+    team(slug: $team) {
+      members(first: 100, after: $cursor, membership: $membership) {
+        pageInfo { hasNextPage endCursor }
+        nodes { login }
+      }
+    }
+  }
+}`
+)
+
+// Resolves members of GitHub organization teams, given as org/team-slug, through the GitHub GraphQL API. Members
+// of child teams are included unless only direct members are asked for. Members are named by their login.
+type GitHubService struct {
+	Client *http.Client
+	// The API URL, https://api.github.com or https://<host>/api for GitHub Enterprise Server
+	URL string
+	CallConfig
+}
+
+type GitHubUser struct {
+	Login string `json:"login"`
+}
+
+type gitHubMembersResponse struct {
+	Data struct {
+		Organization *struct {
+			Team *struct {
+				Members struct {
+					PageInfo struct {
+						HasNextPage bool   `json:"hasNextPage"`
+						EndCursor   string `json:"endCursor"`
+					} `json:"pageInfo"`
+					Nodes []GitHubUser `json:"nodes"`
+				} `json:"members"`
+			} `json:"team"`
+		} `json:"organization"`
+	} `json:"data"`
+	Errors []struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+// Creates a GitHub service authorized with a token that may read the organization's teams (read:org)
+func NewGitHubService(url, token string) *GitHubService {
+	client := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}))
+	return &GitHubService{
+		Client:     client,
+		URL:        strings.TrimSuffix(url, "/"),
+		CallConfig: DefaultCallConfig,
+	}
+}
+
+func (g *GitHubService) String() string {
+	return fmt.Sprintf("GitHub %s", g.URL)
+}
+
+// Gets the members of a team given as org/team-slug, by login
+func (g *GitHubService) getMembers(ctx context.Context, team string, options LookupOptions) ([]Member, error) {
+	users, err := g.listMembers(ctx, team, options)
+	if err != nil {
+		promErrors.WithLabelValues("get-members").Inc()
+		return nil, fmt.Errorf("unable to get members: %w", err)
+	}
+
+	var members []Member
+	for _, user := range users {
+		members = append(members, Member{Email: user.Login, Type: MemberTypeUser})
+	}
+
+	return members, nil
+}
+
+// Lists the members of a team page by page
+func (g *GitHubService) listMembers(ctx context.Context, team string, options LookupOptions) ([]GitHubUser, error) {
+	org, slug, ok := strings.Cut(team, "/")
+	if !ok || org == "" || slug == "" || strings.Contains(slug, "/") {
+		return nil, fmt.Errorf("team %s is not given as org/team-slug", team)
+	}
+
+	membership := gitHubMembershipAll
+	if options.DirectMembersOnly {
+		membership = gitHubMembershipImmediate
+	}
+
+	var users []GitHubUser
+	variables := map[string]interface{}{"org": org, "team": slug, "membership": membership}
+	for {
+		var page gitHubMembersResponse
+		err := g.call(ctx, "github-get-members", func(ctx context.Context) error {
+			return g.query(ctx, variables, &page)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// GitHub answers the same for teams that do not exist and for teams the token may not see, e.g. secret teams
+		// or a token that lost read:org, so this is a failed lookup rather than a group that is gone
+		if page.Data.Organization == nil || page.Data.Organization.Team == nil {
+			return nil, fmt.Errorf("team %s not found, or not visible to the token", team)
+		}
+
+		members := page.Data.Organization.Team.Members
+		users = append(users, members.Nodes...)
+		if !members.PageInfo.HasNextPage {
+			return users, nil
+		}
+		variables["cursor"] = members.PageInfo.EndCursor
+	}
+}
+
+func (g *GitHubService) query(ctx context.Context, variables map[string]interface{}, response *gitHubMembersResponse) error {
+	body, err := json.Marshal(map[string]interface{}{"query": gitHubTeamMembersQuery, "variables": variables})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, g.URL+"/graphql", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return &HTTPError{StatusCode: resp.StatusCode, Header: resp.Header, Body: string(body)}
+	}
+
+	*response = gitHubMembersResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return err
+	}
+
+	for _, e := range response.Errors {
+		// GraphQL rate limiting is reported in the body, with the rate limit headers set as for REST
+		if e.Type == gitHubRateLimitedErrorType {
+			return &HTTPError{StatusCode: http.StatusForbidden, Header: resp.Header, Body: e.Message}
+		}
+	}
+	if len(response.Errors) > 0 {
+		return fmt.Errorf("GraphQL error: %s", response.Errors[0].Message)
+	}
+
+	return nil
+}
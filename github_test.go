@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Stand-in for the GitHub GraphQL API, serving members of teams by org/team-slug and membership, a page at a time
+func gitHubHandler(teams map[string]map[string][]GitHubUser, pageSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/graphql" || r.Header.Get("Authorization") != "Bearer github-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var request struct {
+			Variables struct {
+				Org        string `json:"org"`
+				Team       string `json:"team"`
+				Membership string `json:"membership"`
+				Cursor     string `json:"cursor"`
+			} `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+
+		team, ok := teams[request.Variables.Org+"/"+request.Variables.Team]
+		if !ok {
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"organization": map[string]interface{}{"team": nil}}})
+			return
+		}
+
+		members, next := testPage(team[request.Variables.Membership], request.Variables.Cursor, pageSize)
+		pageInfo := map[string]interface{}{"hasNextPage": next != "", "endCursor": next}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"organization": map[string]interface{}{
+			"team": map[string]interface{}{"members": map[string]interface{}{"pageInfo": pageInfo, "nodes": members}},
+		}}})
+	}
+}
+
+func newTestGitHubService(t *testing.T, handler http.Handler) *GitHubService {
+	server := testServer(t, handler)
+
+	service := NewGitHubService(server.URL, "github-token")
+	service.Retry.BaseDelay = time.Millisecond
+	return service
+}
+
+func TestGitHubService(t *testing.T) {
+	ctx := context.Background()
+	teams := map[string]map[string][]GitHubUser{
+		"nais/team": {
+			gitHubMembershipAll:       {{Login: "Alice"}, {Login: "bob"}, {Login: "child-member"}},
+			gitHubMembershipImmediate: {{Login: "Alice"}, {Login: "bob"}},
+		},
+	}
+
+	t.Run("members including child teams, across pages", func(t *testing.T) {
+		service := newTestGitHubService(t, gitHubHandler(teams, 2))
+		members, err := service.getMembers(ctx, "nais/team", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Alice", "bob", "child-member"}, emails(members))
+	})
+
+	t.Run("direct members only", func(t *testing.T) {
+		service := newTestGitHubService(t, gitHubHandler(teams, 2))
+		members, err := service.getMembers(ctx, "nais/team", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Alice", "bob"}, emails(members))
+	})
+
+	t.Run("unknown or malformed team", func(t *testing.T) {
+		service := newTestGitHubService(t, gitHubHandler(teams, 2))
+		_, err := service.getMembers(ctx, "nais/unknown", LookupOptions{})
+		assert.ErrorContains(t, err, "not visible to the token")
+		assert.False(t, isGroupNotFound(err), "hidden teams look the same")
+
+		_, err = service.getMembers(ctx, "team", LookupOptions{})
+		assert.Error(t, err)
+		assert.False(t, isGroupNotFound(err))
+	})
+
+	t.Run("rate limited requests are retried after the reset", func(t *testing.T) {
+		handler, requests := failingHandler(1, http.StatusForbidden, http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(time.Now().Unix(), 10)},
+		}, gitHubHandler(teams, 10))
+		service := newTestGitHubService(t, handler)
+
+		members, err := service.getMembers(ctx, "nais/team", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 3)
+		assert.Equal(t, int32(2), requests.Load())
+	})
+
+	t.Run("delay until the rate limit resets", func(t *testing.T) {
+		err := &HTTPError{StatusCode: http.StatusForbidden, Header: http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)},
+		}}
+		assert.True(t, isRetryable(ctx, err))
+		assert.Greater(t, RetryConfig{BaseDelay: time.Second, MaxDelay: time.Hour}.delay(0, err), 55*time.Second)
+		assert.Equal(t, DefaultRetryConfig.MaxDelay, DefaultRetryConfig.delay(0, err), "capped at max delay")
+
+		assert.False(t, isRetryable(ctx, &HTTPError{StatusCode: http.StatusForbidden, Header: http.Header{}}))
+	})
+}
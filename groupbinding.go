@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	GroupBindingVersion = "v1alpha1"
+	// The condition telling whether the role bindings of a GroupBinding match its group
+	GroupBindingReady = "Ready"
+	// The role bindings were generated and applied
+	GroupBindingReasonSynchronized = "Synchronized"
+	// The role bindings of the GroupBinding could not be generated, e.g. because the group lookup failed, and the ones
+	// of its last synchronization are kept
+	GroupBindingReasonFailed = "Failed"
+	// Something else in the namespace failed, and its role bindings are kept as they are
+	GroupBindingReasonNamespaceFailed = "NamespaceFailed"
+)
+
+var GroupBindingResource = schema.GroupVersionResource{Group: AnnotationNS, Version: GroupBindingVersion, Resource: "groupbindings"}
+
+// Binds the members of a group to roles in the namespace of the GroupBinding, like the namespace annotations do for
+// those who cannot edit their namespace. Settings left out fall back to the namespace annotations and the flags.
+type GroupBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   GroupBindingSpec   `json:"spec"`
+	Status GroupBindingStatus `json:"status,omitempty"`
+}
+
+type GroupBindingSpec struct {
+	// The group to bind, e.g. team@example.com
+	Group string `json:"group"`
+	// The provider to look up the group in. Defaults to the provider prefix of the group, or the default provider.
+	Provider string `json:"provider,omitempty"`
+	// ClusterRoles to bind the members to
+	Roles []string `json:"roles,omitempty"`
+	// ClusterRoles by member role in the group (OWNER, MANAGER, MEMBER or *), instead of roles
+	MemberRoles map[string][]string `json:"memberRoles,omitempty"`
+	// How to bind the group: user, group or hybrid
+	SubjectMode string `json:"subjectMode,omitempty"`
+	// Prefix of the role binding names. Defaults to the name of the GroupBinding.
+	RoleBindingPrefix string             `json:"roleBindingPrefix,omitempty"`
+	DirectMembersOnly bool               `json:"directMembersOnly,omitempty"`
+	Filter            GroupBindingFilter `json:"filter,omitempty"`
+}
+
+// Lists replace the ones of the namespace annotations and flags when given. An empty list allows anything.
+type GroupBindingFilter struct {
+	Statuses []string `json:"statuses,omitempty"`
+	Types    []string `json:"types,omitempty"`
+	Domains  []string `json:"domains,omitempty"`
+}
+
+type GroupBindingStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Number of subjects bound in the last successful synchronization. A group bound as it is counts as one.
+	Members      int      `json:"members"`
+	RoleBindings []string `json:"roleBindings,omitempty"`
+	// When the role bindings were last synchronized successfully
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+	// Why the last synchronization failed, empty when it succeeded
+	LastError  string             `json:"lastError,omitempty"`
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// What became of a GroupBinding in a synchronization of its namespace
+type groupBindingResult struct {
+	Members      int
+	RoleBindings []string
+	Err          error
+}
+
+func parseGroupBinding(obj runtime.Object) (GroupBinding, error) {
+	var groupBinding GroupBinding
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return groupBinding, fmt.Errorf("unexpected object in groupbindings: %T", obj)
+	}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &groupBinding); err != nil {
+		return groupBinding, fmt.Errorf("unable to parse groupbinding %s/%s: %s", u.GetNamespace(), u.GetName(), err)
+	}
+
+	return groupBinding, nil
+}
+
+// Returns the GroupBindings of a namespace, or of all namespaces, from the informer cache when running and from the
+// API otherwise. Nothing is returned when GroupBindings are not synchronized.
+func (s *Synchronizer) getGroupBindings(ctx context.Context, namespace string) ([]GroupBinding, error) {
+	if s.DynamicClient == nil {
+		return nil, nil
+	}
+
+	var objects []runtime.Object
+	switch {
+	case s.groupBindingLister != nil && namespace == metav1.NamespaceAll:
+		cached, err := s.groupBindingLister.List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("unable to list groupbindings from cache: %s", err)
+		}
+		objects = cached
+	case s.groupBindingLister != nil:
+		cached, err := s.groupBindingLister.ByNamespace(namespace).List(labels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("unable to list groupbindings in namespace %s from cache: %s", namespace, err)
+		}
+		objects = cached
+	default:
+		list, err := s.DynamicClient.Resource(GroupBindingResource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			promErrors.WithLabelValues("get-groupbindings").Inc()
+			return nil, fmt.Errorf("unable to list groupbindings: %s", err)
+		}
+		for i := range list.Items {
+			objects = append(objects, &list.Items[i])
+		}
+	}
+
+	groupBindings := make([]GroupBinding, 0, len(objects))
+	for _, obj := range objects {
+		groupBinding, err := parseGroupBinding(obj)
+		if err != nil {
+			promErrors.WithLabelValues("parse-groupbinding").Inc()
+			return nil, err
+		}
+		groupBindings = append(groupBindings, groupBinding)
+	}
+
+	// The same order every time, so that duplicate role binding names are reported the same way
+	sort.Slice(groupBindings, func(i, j int) bool {
+		return groupBindings[i].Name < groupBindings[j].Name
+	})
+
+	return groupBindings, nil
+}
+
+// Returns the binding described by a GroupBinding, with the settings it leaves out taken from the annotations of
+// its namespace and the flags
+func (s *Synchronizer) groupBindingBinding(ns corev1.Namespace, groupBinding GroupBinding) (Binding, error) {
+	spec := groupBinding.Spec
+	if strings.TrimSpace(spec.Group) == "" {
+		return Binding{}, fmt.Errorf("spec.group is required")
+	}
+
+	group := spec.Group
+	if spec.Provider != "" {
+		if !isProvider(spec.Provider) {
+			return Binding{}, fmt.Errorf("unknown provider %s, must be one of %s", spec.Provider, strings.Join(Providers, ", "))
+		}
+		switch provider, _ := splitProvider(group); provider {
+		case "":
+			group = spec.Provider + ":" + group
+		case spec.Provider:
+		default:
+			return Binding{}, fmt.Errorf("group %s has another provider prefix than provider %s", group, spec.Provider)
+		}
+	}
+
+	binding := Binding{
+		Group:             group,
+		Prefix:            ensureVal(spec.RoleBindingPrefix, groupBinding.Name),
+		Roles:             spec.Roles,
+		SubjectMode:       ensureVal(spec.SubjectMode, ensureVal(ns.Annotations[SubjectModeAnnotation], s.SubjectMode)),
+		Filter:            s.MemberFilter.forNamespace(ns),
+		DirectMembersOnly: spec.DirectMembersOnly || ns.Annotations[DirectMembersOnlyAnnotation] == "true",
+	}
+
+	if !isSubjectMode(binding.SubjectMode) {
+		return Binding{}, fmt.Errorf("unknown subject mode %s, must be %s, %s or %s", binding.SubjectMode, SubjectModeUser, SubjectModeGroup, SubjectModeHybrid)
+	}
+
+	if spec.Filter.Statuses != nil {
+		binding.Filter.Statuses = spec.Filter.Statuses
+	}
+	if spec.Filter.Types != nil {
+		binding.Filter.Types = spec.Filter.Types
+	}
+	if spec.Filter.Domains != nil {
+		binding.Filter.Domains = spec.Filter.Domains
+	}
+
+	var err error
+	if binding.Templates, err = s.subjectTemplates(ns, group); err != nil {
+		return Binding{}, err
+	}
+
+	// Members of groups bound as they are cannot be told apart by role
+	if binding.SubjectMode != SubjectModeGroup {
+		if len(spec.MemberRoles) > 0 {
+			if binding.MemberRoles, err = ParseRoleMapping(memberRolePairs(spec.MemberRoles)); err != nil {
+				return Binding{}, fmt.Errorf("spec.memberRoles: %s", err)
+			}
+		} else if binding.MemberRoles, err = s.memberRoles(ns, spec.Roles); err != nil {
+			return Binding{}, fmt.Errorf("invalid %s annotation: %s", MemberRolesAnnotation, err)
+		}
+	}
+
+	if len(binding.Roles) == 0 {
+		binding.Roles = strings.Split(s.DefaultRoles, ",")
+	}
+
+	// GroupBindings are created by users of the namespace, who must not be able to bind roles beyond the allowed ones,
+	// as the role bindings are created by rbac-sync rather than by them
+	roles := binding.Roles
+	if len(binding.MemberRoles) > 0 {
+		roles = binding.MemberRoles.clusterRoles()
+	}
+	if denied := s.deniedGroupBindingRoles(roles); len(denied) > 0 {
+		promErrors.WithLabelValues("groupbinding-role-denied").Inc()
+		return Binding{}, fmt.Errorf("clusterroles %s may not be bound by groupbindings, allowed are %s", strings.Join(denied, ", "), strings.Join(s.allowedGroupBindingRoles(), ", "))
+	}
+
+	return binding, nil
+}
+
+// Returns the ClusterRoles that GroupBindings may bind
+func (s *Synchronizer) allowedGroupBindingRoles() []string {
+	if len(s.GroupBindingAllowedRoles) > 0 {
+		return s.GroupBindingAllowedRoles
+	}
+	return append(splitList(s.DefaultRoles), s.DefaultMemberRoles.clusterRoles()...)
+}
+
+// Returns the roles that GroupBindings may not bind
+func (s *Synchronizer) deniedGroupBindingRoles(roles []string) (denied []string) {
+	allowed := map[string]bool{}
+	for _, role := range s.allowedGroupBindingRoles() {
+		allowed[role] = true
+	}
+
+	for _, role := range roles {
+		if !allowed[role] {
+			denied = append(denied, role)
+		}
+	}
+	return
+}
+
+// Returns the member roles of a GroupBinding as comma-separated <member role>=<cluster role> pairs
+func memberRolePairs(memberRoles map[string][]string) string {
+	var pairs []string
+	for memberRole, clusterRoles := range memberRoles {
+		for _, clusterRole := range clusterRoles {
+			pairs = append(pairs, memberRole+"="+clusterRole)
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Returns the managed role bindings of the last successful synchronization of a GroupBinding, from the informer cache
+// when running and from the API otherwise
+func (s *Synchronizer) getLastRoleBindings(ctx context.Context, groupBinding GroupBinding) ([]rbacv1.RoleBinding, error) {
+	var roleBindings []rbacv1.RoleBinding
+	for _, name := range groupBinding.Status.RoleBindings {
+		var roleBinding *rbacv1.RoleBinding
+		var err error
+		if s.roleBindingLister != nil {
+			roleBinding, err = s.roleBindingLister.RoleBindings(groupBinding.Namespace).Get(name)
+		} else {
+			roleBinding, err = s.Clientset.RbacV1().RoleBindings(groupBinding.Namespace).Get(ctx, name, metav1.GetOptions{})
+		}
+
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get rolebinding %s of groupbinding %s: %s", name, groupBinding.Name, err)
+		}
+		if roleBinding.Labels[ManagedLabel] == "true" {
+			roleBindings = append(roleBindings, *roleBinding.DeepCopy())
+		}
+	}
+
+	return roleBindings, nil
+}
+
+// Returns the names of the GroupBindings that failed
+func failedGroupBindings(results map[string]groupBindingResult) (failed []string) {
+	for name, result := range results {
+		if result.Err != nil {
+			failed = append(failed, name)
+		}
+	}
+	sort.Strings(failed)
+	return
+}
+
+// Returns the number of distinct subjects bound by the role bindings
+func countSubjects(roleBindings []rbacv1.RoleBinding) int {
+	seen := map[rbacv1.Subject]bool{}
+	for _, roleBinding := range roleBindings {
+		for _, subject := range roleBinding.Subjects {
+			seen[subjectKey(subject)] = true
+		}
+	}
+	return len(seen)
+}
+
+// Returns the status of the GroupBinding after a synchronization with the given result. An error of the namespace
+// applies to GroupBindings that did not fail on their own.
+func (g GroupBinding) statusAfter(result groupBindingResult, namespaceErr error, now metav1.Time) GroupBindingStatus {
+	status := g.Status
+	status.Conditions = append([]metav1.Condition(nil), g.Status.Conditions...)
+	status.ObservedGeneration = g.Generation
+
+	condition := metav1.Condition{Type: GroupBindingReady, ObservedGeneration: g.Generation}
+	switch {
+	case result.Err != nil:
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, GroupBindingReasonFailed, result.Err.Error()
+		status.LastError = result.Err.Error()
+	case namespaceErr != nil:
+		message := fmt.Sprintf("role bindings are kept as they are: %s", namespaceErr)
+		condition.Status, condition.Reason, condition.Message = metav1.ConditionFalse, GroupBindingReasonNamespaceFailed, message
+		status.LastError = message
+	default:
+		condition.Status, condition.Reason = metav1.ConditionTrue, GroupBindingReasonSynchronized
+		condition.Message = fmt.Sprintf("%d subjects bound by rolebindings %s", result.Members, strings.Join(result.RoleBindings, ", "))
+		status.Members = result.Members
+		status.RoleBindings = result.RoleBindings
+		status.LastSyncTime = &now
+		status.LastError = ""
+	}
+
+	meta.SetStatusCondition(&status.Conditions, condition)
+	return status
+}
+
+// Reports the result of synchronizing a namespace in the status of its GroupBindings. Failing to do so is logged
+// rather than failing the synchronization, as the role bindings are already in place.
+func (s *Synchronizer) updateGroupBindingStatuses(ctx context.Context, groupBindings []GroupBinding, results map[string]groupBindingResult, namespaceErr error) {
+	if s.DryRun {
+		return
+	}
+
+	now := metav1.Now()
+	for _, groupBinding := range groupBindings {
+		status := groupBinding.statusAfter(results[groupBinding.Name], namespaceErr, now)
+		if equality.Semantic.DeepEqual(status, groupBinding.Status) {
+			continue
+		}
+
+		groupBinding.Status = status
+		if err := s.updateGroupBindingStatus(ctx, groupBinding); err != nil {
+			promErrors.WithLabelValues("update-groupbinding-status").Inc()
+			log.Errorf("unable to update status of groupbinding %s in namespace %s: %s", groupBinding.Name, groupBinding.Namespace, err)
+		}
+	}
+}
+
+func (s *Synchronizer) updateGroupBindingStatus(ctx context.Context, groupBinding GroupBinding) error {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&groupBinding)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DynamicClient.Resource(GroupBindingResource).Namespace(groupBinding.Namespace).UpdateStatus(ctx, &unstructured.Unstructured{Object: object}, metav1.UpdateOptions{FieldManager: FieldManager})
+	if errors.IsConflict(err) {
+		// The GroupBinding changed since it was cached, and the change queues the namespace again
+		log.Debugf("groupbinding %s in namespace %s changed before its status was updated", groupBinding.Name, groupBinding.Namespace)
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func groupBinding(namespace, name string, spec GroupBindingSpec) *unstructured.Unstructured {
+	object, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&GroupBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: GroupBindingResource.GroupVersion().String(), Kind: "GroupBinding"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Generation: 1},
+		Spec:       spec,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return &unstructured.Unstructured{Object: object}
+}
+
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		GroupBindingResource: "GroupBindingList",
+	}, objects...)
+}
+
+func TestParseGroupBinding(t *testing.T) {
+	t.Run("empty filter lists are kept apart from missing ones", func(t *testing.T) {
+		object := groupBinding("team", "devteam", GroupBindingSpec{Group: "team@acme.no"})
+		assert.NoError(t, unstructured.SetNestedStringSlice(object.Object, []string{}, "spec", "filter", "statuses"))
+
+		parsed, err := parseGroupBinding(object)
+		assert.NoError(t, err)
+		assert.Equal(t, "team@acme.no", parsed.Spec.Group)
+		assert.NotNil(t, parsed.Spec.Filter.Statuses)
+		assert.Nil(t, parsed.Spec.Filter.Domains)
+	})
+
+	t.Run("invalid fields", func(t *testing.T) {
+		object := groupBinding("team", "devteam", GroupBindingSpec{Group: "team@acme.no"})
+		assert.NoError(t, unstructured.SetNestedField(object.Object, "edit", "spec", "roles"))
+
+		_, err := parseGroupBinding(object)
+		assert.Error(t, err)
+	})
+}
+
+func TestGroupBindingBinding(t *testing.T) {
+	synchronizer := NewSynchronizer(newFakeClientset(), MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "view", "rbacsync")
+	synchronizer.MemberFilter = NewMemberFilter("ACTIVE", "", "acme.no")
+	synchronizer.GroupBindingAllowedRoles = []string{"view", "edit", "admin"}
+	ns := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}}
+	bind := func(spec GroupBindingSpec) (Binding, error) {
+		parsed, err := parseGroupBinding(groupBinding("team", "devteam", spec))
+		assert.NoError(t, err)
+		return synchronizer.groupBindingBinding(ns, parsed)
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		binding, err := bind(GroupBindingSpec{Group: "team@acme.no"})
+		assert.NoError(t, err)
+		assert.Equal(t, "team@acme.no", binding.Group)
+		assert.Equal(t, "devteam", binding.Prefix)
+		assert.Equal(t, []string{"view"}, binding.Roles)
+		assert.Equal(t, SubjectModeUser, binding.SubjectMode)
+		assert.Equal(t, synchronizer.MemberFilter, binding.Filter)
+	})
+
+	t.Run("provider is prefixed to the group", func(t *testing.T) {
+		binding, err := bind(GroupBindingSpec{Group: "team@acme.no", Provider: ProviderAzure})
+		assert.NoError(t, err)
+		assert.Equal(t, "azure:team@acme.no", binding.Group)
+
+		binding, err = bind(GroupBindingSpec{Group: "azure:team@acme.no", Provider: ProviderAzure})
+		assert.NoError(t, err)
+		assert.Equal(t, "azure:team@acme.no", binding.Group)
+	})
+
+	t.Run("filter lists replace the global ones", func(t *testing.T) {
+		object := groupBinding("team", "devteam", GroupBindingSpec{Group: "team@acme.no", Filter: GroupBindingFilter{Types: []string{MemberTypeUser}}})
+		assert.NoError(t, unstructured.SetNestedStringSlice(object.Object, []string{}, "spec", "filter", "statuses"))
+		parsed, err := parseGroupBinding(object)
+		assert.NoError(t, err)
+
+		binding, err := synchronizer.groupBindingBinding(ns, parsed)
+		assert.NoError(t, err)
+		assert.Equal(t, MemberFilter{Statuses: []string{}, Types: []string{MemberTypeUser}, Domains: []string{"acme.no"}}, binding.Filter)
+	})
+
+	t.Run("member roles", func(t *testing.T) {
+		binding, err := bind(GroupBindingSpec{Group: "team@acme.no", MemberRoles: map[string][]string{"owner": {"admin"}, "*": {"view"}}})
+		assert.NoError(t, err)
+		assert.Equal(t, RoleMapping{MemberRoleOwner: {"admin"}, AnyMemberRole: {"view"}}, binding.MemberRoles)
+	})
+
+	t.Run("roles win over the member roles annotation", func(t *testing.T) {
+		annotated := corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Annotations: map[string]string{MemberRolesAnnotation: "OWNER=admin"}}}
+		parsed, err := parseGroupBinding(groupBinding("team", "devteam", GroupBindingSpec{Group: "team@acme.no", Roles: []string{"edit"}}))
+		assert.NoError(t, err)
+
+		binding, err := synchronizer.groupBindingBinding(annotated, parsed)
+		assert.NoError(t, err)
+		assert.Empty(t, binding.MemberRoles)
+		assert.Equal(t, []string{"edit"}, binding.Roles)
+	})
+
+	t.Run("roles that are not allowed are refused", func(t *testing.T) {
+		_, err := bind(GroupBindingSpec{Group: "system:authenticated", SubjectMode: SubjectModeGroup, Roles: []string{"view", "cluster-admin"}})
+		assert.ErrorContains(t, err, "clusterroles cluster-admin may not be bound by groupbindings")
+
+		_, err = bind(GroupBindingSpec{Group: "team@acme.no", MemberRoles: map[string][]string{"*": {"cluster-admin"}}})
+		assert.ErrorContains(t, err, "clusterroles cluster-admin may not be bound by groupbindings")
+	})
+
+	t.Run("only the default roles are allowed unless roles are allowed", func(t *testing.T) {
+		defaults := NewSynchronizer(newFakeClientset(), MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "view", "rbacsync")
+		defaults.DefaultMemberRoles, _ = ParseRoleMapping("OWNER=admin")
+		for role, allowed := range map[string]bool{"view": true, "admin": true, "edit": false, "cluster-admin": false} {
+			parsed, err := parseGroupBinding(groupBinding("team", "devteam", GroupBindingSpec{Group: "team@acme.no", Roles: []string{role}}))
+			assert.NoError(t, err)
+
+			_, err = defaults.groupBindingBinding(ns, parsed)
+			assert.Equal(t, allowed, err == nil, role)
+		}
+	})
+
+	t.Run("invalid specs", func(t *testing.T) {
+		for _, spec := range []GroupBindingSpec{
+			{},
+			{Group: "team@acme.no", Provider: "unknown"},
+			{Group: "github:team", Provider: ProviderAzure},
+			{Group: "team@acme.no", SubjectMode: "everyone"},
+			{Group: "team@acme.no", MemberRoles: map[string][]string{"BOSS": {"admin"}}},
+		} {
+			_, err := bind(spec)
+			assert.Error(t, err, "%+v", spec)
+		}
+	})
+}
+
+func TestGroupBindingStatusAfter(t *testing.T) {
+	now := metav1.NewTime(time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC))
+	synced := GroupBinding{ObjectMeta: metav1.ObjectMeta{Generation: 2}}
+	synced.Status = synced.statusAfter(groupBindingResult{Members: 3, RoleBindings: []string{"devteam-view"}}, nil, now)
+
+	t.Run("synchronized", func(t *testing.T) {
+		assert.Equal(t, int64(2), synced.Status.ObservedGeneration)
+		assert.Equal(t, 3, synced.Status.Members)
+		assert.Equal(t, []string{"devteam-view"}, synced.Status.RoleBindings)
+		assert.Equal(t, &now, synced.Status.LastSyncTime)
+		assert.Empty(t, synced.Status.LastError)
+		assert.True(t, meta.IsStatusConditionTrue(synced.Status.Conditions, GroupBindingReady))
+	})
+
+	t.Run("failed keeps the last synchronization", func(t *testing.T) {
+		status := synced.statusAfter(groupBindingResult{Err: fmt.Errorf("group doesnt exist")}, fmt.Errorf("namespace is stale"), metav1.NewTime(now.Add(time.Hour)))
+		assert.Equal(t, 3, status.Members)
+		assert.Equal(t, &now, status.LastSyncTime)
+		assert.Equal(t, "group doesnt exist", status.LastError)
+
+		ready := meta.FindStatusCondition(status.Conditions, GroupBindingReady)
+		assert.Equal(t, metav1.ConditionFalse, ready.Status)
+		assert.Equal(t, GroupBindingReasonFailed, ready.Reason)
+		assert.True(t, meta.IsStatusConditionTrue(synced.Status.Conditions, GroupBindingReady), "the current status is left alone")
+	})
+
+	t.Run("namespace failed", func(t *testing.T) {
+		status := synced.statusAfter(groupBindingResult{}, fmt.Errorf("namespace is stale"), now)
+		assert.Contains(t, status.LastError, "namespace is stale")
+		assert.Equal(t, GroupBindingReasonNamespaceFailed, meta.FindStatusCondition(status.Conditions, GroupBindingReady).Reason)
+	})
+}
+
+func TestSynchronizerGroupBindings(t *testing.T) {
+	ctx := context.Background()
+	existing := roleBinding("broken", "team", "edit", subjects([]string{"a@b.com"}))
+	clientSet := newFakeClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team"}}, &existing)
+	broken := groupBinding("team", "broken", GroupBindingSpec{Group: "nonexistent", Roles: []string{"edit"}})
+	assert.NoError(t, unstructured.SetNestedStringSlice(broken.Object, []string{"broken-edit"}, "status", "roleBindings"))
+	dynamicClient := newFakeDynamicClient(
+		broken,
+		groupBinding("team", "devteam", GroupBindingSpec{Group: "team@acme.no", Roles: []string{"edit"}}),
+		groupBinding("team", "oncall", GroupBindingSpec{Group: "team@acme.no", Roles: []string{"edit"}, RoleBindingPrefix: "devteam"}),
+	)
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "view", "rbacsync")
+	synchronizer.DynamicClient = dynamicClient
+	synchronizer.GroupBindingAllowedRoles = []string{"view", "edit"}
+
+	status := func(name string) GroupBindingStatus {
+		object, err := dynamicClient.Resource(GroupBindingResource).Namespace("team").Get(ctx, name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		parsed, err := parseGroupBinding(object)
+		assert.NoError(t, err)
+		return parsed.Status
+	}
+	ready := func(name string) bool {
+		return meta.IsStatusConditionTrue(status(name).Conditions, GroupBindingReady)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go synchronizer.Run(stopCh, 1)
+
+	t.Run("creates role bindings and reports the status", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return ready("devteam") }, 5*time.Second, 50*time.Millisecond)
+
+		rolebinding, err := clientSet.RbacV1().RoleBindings("team").Get(ctx, "devteam-edit", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@b.com", "d@e.fi", "h@i.jp"}, subjectNames(rolebinding.Subjects))
+
+		current := status("devteam")
+		assert.Equal(t, 3, current.Members)
+		assert.Equal(t, []string{"devteam-edit"}, current.RoleBindings)
+		assert.NotNil(t, current.LastSyncTime)
+		assert.Empty(t, current.LastError)
+	})
+
+	t.Run("failing groupbindings fail on their own", func(t *testing.T) {
+		assert.Eventually(t, func() bool { return status("oncall").LastError != "" && status("broken").LastError != "" }, 5*time.Second, 50*time.Millisecond)
+		assert.Contains(t, status("oncall").LastError, "generated for both groupbinding devteam and groupbinding oncall")
+		assert.Equal(t, GroupBindingReasonFailed, meta.FindStatusCondition(status("broken").Conditions, GroupBindingReady).Reason)
+		assert.Equal(t, float64(0), testutil.ToFloat64(promStale.WithLabelValues("team")), "the namespace is not stale")
+
+		kept, err := clientSet.RbacV1().RoleBindings("team").Get(ctx, "broken-edit", metav1.GetOptions{})
+		assert.NoError(t, err, "role bindings of the last synchronization are kept")
+		assert.Equal(t, existing.Subjects, kept.Subjects)
+	})
+
+	t.Run("plan includes namespaces with group bindings only", func(t *testing.T) {
+		namespaces, err := synchronizer.getTargetNamespaces(ctx)
+		assert.NoError(t, err)
+		assert.Len(t, namespaces, 1)
+	})
+}
@@ -2,110 +2,337 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
-	"io/ioutil"
+	"google.golang.org/api/option"
+	"net/http"
 	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultMaxGroupDepth     = 10
+	AuthModeKeyFile          = "keyfile"
+	AuthModeWorkloadIdentity = "workload-identity"
+	ProviderGoogle           = "google"
+	ProviderAzure            = "azure"
+	ProviderLDAP             = "ldap"
+	ProviderGitHub           = "github"
+	ProviderFile             = "file"
+	ProviderCloudIdentity    = "cloudidentity"
 )
 
+var Providers = []string{ProviderGoogle, ProviderCloudIdentity, ProviderAzure, ProviderLDAP, ProviderGitHub, ProviderFile}
+
+func isProvider(name string) bool {
+	for _, provider := range Providers {
+		if name == provider {
+			return true
+		}
+	}
+	return false
+}
+
 type IAMClient interface {
-	getMembers(groupEmail string) ([]string, error)
+	getMembers(ctx context.Context, groupEmail string, options LookupOptions) ([]Member, error)
+}
+
+const (
+	MemberTypeUser           = "USER"
+	MemberTypeServiceAccount = "SERVICE_ACCOUNT"
+	MemberTypeGroup          = "GROUP"
+	MemberStatusActive       = "ACTIVE"
+	MemberStatusSuspended    = "SUSPENDED"
+	MemberRoleOwner          = "OWNER"
+	MemberRoleManager        = "MANAGER"
+	MemberRoleMember         = "MEMBER"
+)
+
+// A member of a group, as found by an IAM client
+type Member struct {
+	Email string
+	// USER, SERVICE_ACCOUNT, or another type given by the provider, e.g. CUSTOMER or EXTERNAL for Google groups
+	Type string
+	// ACTIVE, SUSPENDED, or another status given by the provider. Empty if the provider does not tell.
+	Status string
+	// OWNER, MANAGER or MEMBER of the group. Empty if the provider does not tell.
+	Role string
+}
+
+func user(email, status string) Member {
+	return Member{Email: email, Type: memberType(MemberTypeUser, email), Status: status}
+}
+
+// Google service accounts are listed as users, and are told apart by their domain
+func memberType(memberType, email string) string {
+	if memberType == MemberTypeUser && strings.HasSuffix(strings.ToLower(email), ".gserviceaccount.com") {
+		return MemberTypeServiceAccount
+	}
+	return memberType
+}
+
+// Returns the higher ranking of two member roles, where OWNER ranks above MANAGER above MEMBER
+func higherRole(role1, role2 string) string {
+	rank := map[string]int{MemberRoleMember: 1, MemberRoleManager: 2, MemberRoleOwner: 3}
+	if rank[role2] > rank[role1] {
+		return role2
+	}
+	return role1
+}
+
+func emails(members []Member) (emails []string) {
+	for _, member := range members {
+		emails = append(emails, member.Email)
+	}
+
+	return
+}
+
+// Options for looking up the members of a group
+type LookupOptions struct {
+	// Only return the direct members of the group, skipping nested groups
+	DirectMembersOnly bool
+	// Return nested groups as members of type GROUP instead of expanding them, along with the direct users
+	IncludeGroups bool
+}
+
+// A group that does not exist, e.g. because it has been deleted. Its role bindings are emptied, unlike when the
+// lookup fails for other reasons.
+type GroupNotFoundError struct {
+	Group string
+}
+
+func (e *GroupNotFoundError) Error() string {
+	return fmt.Sprintf("group %s not found", e.Group)
+}
+
+func isGroupNotFound(err error) bool {
+	var notFound *GroupNotFoundError
+	return errors.As(err, &notFound)
+}
+
+// Returns a GroupNotFoundError in place of an API error telling that the group does not exist
+func groupNotFound(group string, err error) error {
+	if code, _, ok := errorResponse(err); ok && code == http.StatusNotFound {
+		return &GroupNotFoundError{Group: group}
+	}
+	return err
+}
+
+// Lists the direct members of a group, with the groups nested in it as members of type GROUP. A group that does not
+// exist fails with a GroupNotFoundError.
+type listDirectFunc func(ctx context.Context, group string) ([]Member, error)
+
+// Gets the members of a group, expanding nested groups until maxDepth unless the options ask for direct members only
+// or for nested groups as groups. Each group is listed once per lookup. Groups that are already being expanded further
+// up are skipped to avoid cycles, while a group reached by several paths is expanded for each of them. Members of a
+// nested group get the role that the nested group has in its parent, and members found more than once keep their
+// highest role.
+func expandGroup(ctx context.Context, group string, maxDepth int, options LookupOptions, listDirect listDirectFunc) ([]Member, error) {
+	expansion := &groupExpansion{
+		maxDepth:   maxDepth,
+		options:    options,
+		listDirect: listDirect,
+		ancestors:  map[string]bool{},
+		listed:     map[string][]Member{},
+	}
+	members, err := expansion.expand(ctx, group, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return uniq(members), nil
+}
+
+type groupExpansion struct {
+	maxDepth   int
+	options    LookupOptions
+	listDirect listDirectFunc
+	ancestors  map[string]bool
+	listed     map[string][]Member
+}
+
+func (e *groupExpansion) expand(ctx context.Context, group string, depth int) ([]Member, error) {
+	key := strings.ToLower(group)
+	e.ancestors[key] = true
+	defer delete(e.ancestors, key)
+
+	direct, ok := e.listed[key]
+	if !ok {
+		var err error
+		if direct, err = e.listDirect(ctx, group); err != nil {
+			return nil, err
+		}
+		e.listed[key] = direct
+	}
+
+	var members []Member
+	for _, member := range direct {
+		if member.Type != MemberTypeGroup || e.options.IncludeGroups {
+			members = append(members, member)
+			continue
+		}
+
+		if e.options.DirectMembersOnly {
+			continue
+		}
+
+		if e.ancestors[strings.ToLower(member.Email)] {
+			log.Warnf("group %s is a member of %s, but contains it, skipping to avoid cycle", member.Email, group)
+			continue
+		}
+
+		if depth >= e.maxDepth {
+			promErrors.WithLabelValues("max-group-depth").Inc()
+			return nil, fmt.Errorf("group %s in %s is nested deeper than the max depth of %d", member.Email, group, e.maxDepth)
+		}
+
+		// A nested group that is missing fails the lookup, rather than emptying the group it is a member of
+		nested, err := e.expand(ctx, member.Email, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("nested group %s: %s", member.Email, err)
+		}
+		for _, nestedMember := range nested {
+			nestedMember.Role = member.Role
+			members = append(members, nestedMember)
+		}
+	}
+
+	return members, nil
 }
 
 type MockAdminService struct{}
 
-func (a MockAdminService) getMembers(groupEmail string) ([]string, error) {
+func (a MockAdminService) getMembers(_ context.Context, groupEmail string, _ LookupOptions) ([]Member, error) {
 	if strings.ToLower(groupEmail) == "nonexistent" {
 		return nil, fmt.Errorf("group doesnt exist")
 	}
+	if strings.ToLower(groupEmail) == "deleted" {
+		return nil, &GroupNotFoundError{Group: groupEmail}
+	}
 
-	return []string{"a@b.com", "d@e.fi", "h@i.jp"}, nil
+	owner := user("a@b.com", MemberStatusActive)
+	owner.Role = MemberRoleOwner
+	return []Member{owner, user("d@e.fi", MemberStatusActive), user("h@i.jp", MemberStatusActive)}, nil
 }
 
 type AdminService struct {
 	Service *admin.Service
+	// How many levels of nested groups to expand
+	MaxDepth int
+	CallConfig
+	// The service account key, when authorized with a key file
+	Credentials *KeyFileCredentials
 }
 
 func NewAdminService(serviceAccountKeyFile, gcpAdminUser string) (*AdminService, error) {
-	service, err := getAdminService(serviceAccountKeyFile, gcpAdminUser)
+	service, credentials, err := getAdminService(serviceAccountKeyFile, gcpAdminUser)
 
 	if err != nil {
 		promErrors.WithLabelValues("new-admin-service").Inc()
 		return nil, fmt.Errorf("unable to create admin service: %s", err)
 	}
 
-	return &AdminService{Service: service}, nil
+	adminService := newAdminService(service)
+	adminService.Credentials = credentials
+	return adminService, nil
 }
 
-// Build and returns an Admin SDK Directory service object authorized with
-// the service accounts that act on behalf of the given user.
-func getAdminService(serviceAccountKeyfile string, gcpAdminUser string) (*admin.Service, error) {
-	jsonCredentials, err := ioutil.ReadFile(serviceAccountKeyfile)
+// Creates an admin service without a service account key file, see getAdminServiceWithWorkloadIdentity
+func NewAdminServiceWithWorkloadIdentity(serviceAccount, gcpAdminUser string, timeout time.Duration) (*AdminService, error) {
+	service, err := getAdminServiceWithWorkloadIdentity(context.Background(), serviceAccount, gcpAdminUser, timeout)
+
 	if err != nil {
-		return nil, fmt.Errorf("unable to read service account key file %s", err)
+		promErrors.WithLabelValues("new-admin-service").Inc()
+		return nil, fmt.Errorf("unable to create admin service: %s", err)
 	}
 
-	config, err := google.JWTConfigFromJSON(jsonCredentials, admin.AdminDirectoryGroupMemberReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
+	return newAdminService(service), nil
+}
+
+func newAdminService(service *admin.Service) *AdminService {
+	return &AdminService{Service: service, MaxDepth: DefaultMaxGroupDepth, CallConfig: DefaultCallConfig}
+}
+
+// Build and returns an Admin SDK Directory service object authorized with
+// the service accounts that act on behalf of the given user.
+func getAdminService(serviceAccountKeyfile string, gcpAdminUser string) (*admin.Service, *KeyFileCredentials, error) {
+	credentials, err := NewKeyFileCredentials(serviceAccountKeyfile, gcpAdminUser, admin.AdminDirectoryGroupMemberReadonlyScope, admin.AdminDirectoryGroupReadonlyScope)
 	if err != nil {
-		return nil, fmt.Errorf("unable to parse service account key file to config: %s", err)
+		return nil, nil, err
 	}
 
-	config.Subject = gcpAdminUser
 	ctx := context.Background()
-	client := config.Client(ctx)
-
-	service, err := admin.New(client)
+	service, err := admin.NewService(ctx, option.WithTokenSource(credentials))
 	if err != nil {
-		return nil, fmt.Errorf("unable to retrieve Google Admin Client: %s", err)
+		return nil, nil, fmt.Errorf("unable to retrieve Google Admin Client: %s", err)
 	}
 
-	return service, nil
+	return service, credentials, nil
 }
 
-// Gets group members by e-mail address recursively
-func (a AdminService) getMembers(groupEmail string) ([]string, error) {
-	members, err := a.getMembersObjects(groupEmail)
-	return extractEmail(members), err
-}
+// Gets group members by e-mail address, expanding nested groups until MaxDepth
+func (a AdminService) getMembers(ctx context.Context, groupEmail string, options LookupOptions) ([]Member, error) {
+	members, err := expandGroup(ctx, groupEmail, a.MaxDepth, options, a.listDirect)
+	if err != nil {
+		promErrors.WithLabelValues("get-members").Inc()
+		return nil, fmt.Errorf("unable to get members: %w", err)
+	}
 
-// Gets group members by e-mail address recursively
-func (a AdminService) getMembersObjects(groupEmail string) ([]*admin.Member, error) {
-	result, err := a.Service.Members.List(groupEmail).Do()
+	return members, nil
+}
 
+// Lists the direct members of a group, with nested groups as members of type GROUP
+func (a AdminService) listDirect(ctx context.Context, groupEmail string) ([]Member, error) {
+	members, err := a.listMembers(ctx, groupEmail)
 	if err != nil {
-		promErrors.WithLabelValues("get-members").Inc()
-		return nil, fmt.Errorf("unable to get members: %s", err)
+		return nil, groupNotFound(groupEmail, err)
 	}
 
-	var userList []*admin.Member
-	for _, member := range result.Members {
-		if member.Type == "GROUP" {
-			groupMembers, _ := a.getMembersObjects(member.Email)
-			userList = append(userList, groupMembers...)
-		} else {
-			userList = append(userList, member)
+	return toMembers(members), nil
+}
+
+// Lists the direct members of a group, page by page
+func (a AdminService) listMembers(ctx context.Context, groupEmail string) ([]*admin.Member, error) {
+	var members []*admin.Member
+	pageToken := ""
+	for {
+		var page *admin.Members
+		err := a.call(ctx, "google-get-members", func(ctx context.Context) (err error) {
+			page, err = a.Service.Members.List(groupEmail).PageToken(pageToken).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return nil, err
 		}
-	}
 
-	return userList, nil
+		members = append(members, page.Members...)
+		if page.NextPageToken == "" {
+			return members, nil
+		}
+		pageToken = page.NextPageToken
+	}
 }
 
-func extractEmail(members []*admin.Member) (emails []string) {
-	for _, member := range members {
-		emails = append(emails, member.Email)
+func toMembers(adminMembers []*admin.Member) (members []Member) {
+	for _, member := range adminMembers {
+		members = append(members, Member{Email: member.Email, Type: memberType(member.Type, member.Email), Status: member.Status, Role: member.Role})
 	}
 
 	return
 }
 
-// Remove duplicates from user list
-func uniq(list []*admin.Member) []*admin.Member {
-	var uniqSet []*admin.Member
+// Remove duplicates from user list, keeping the highest role of a user that is in the list more than once
+func uniq(list []Member) []Member {
+	var uniqSet []Member
 loop:
 	for _, l := range list {
-		for _, x := range uniqSet {
+		for i, x := range uniqSet {
 			if l.Email == x.Email {
+				uniqSet[i].Role = higherRole(x.Role, l.Role)
 				continue loop
 			}
 		}
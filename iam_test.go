@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"k8s.io/api/core/v1"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/option"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -17,7 +28,7 @@ var (
 )
 
 func TestUniq(t *testing.T) {
-	uniqUserList1 := uniq(getTestMembers())
+	uniqUserList1 := uniq(toMembers(getTestMembers()))
 	list1Length := len(uniqUserList1)
 	if list1Length != 1 {
 		t.Errorf("Uniq was incorrect, got: %d, want: %d.", list1Length, 1)
@@ -35,19 +46,19 @@ func TestUniq(t *testing.T) {
 	uniqUserList2 = append(uniqUserList2, member1)
 	uniqUserList2 = append(uniqUserList2, member3)
 	uniqUserList2 = append(uniqUserList2, member2)
-	uniqUserList2 = uniq(uniqUserList2)
-	list2Length := len(uniqUserList2)
+	uniqMembers2 := uniq(toMembers(uniqUserList2))
+	list2Length := len(uniqMembers2)
 	if list2Length != 3 {
 		t.Errorf("Uniq was incorrect, got: %d, want: %d.", list2Length, 3)
 	}
-	if uniqUserList2[0].Email != member1.Email {
-		t.Errorf("Uniq sort was incorrect, got: %q, want: %q.", uniqUserList2[0].Email, member1.Email)
+	if uniqMembers2[0].Email != member1.Email {
+		t.Errorf("Uniq sort was incorrect, got: %q, want: %q.", uniqMembers2[0].Email, member1.Email)
 	}
-	if uniqUserList2[1].Email != member2.Email {
-		t.Errorf("Uniq sort was incorrect, got: %q, want: %q.", uniqUserList2[1].Email, member2.Email)
+	if uniqMembers2[1].Email != member2.Email {
+		t.Errorf("Uniq sort was incorrect, got: %q, want: %q.", uniqMembers2[1].Email, member2.Email)
 	}
-	if uniqUserList2[2].Email != member3.Email {
-		t.Errorf("Uniq sort was incorrect, got: %q, want: %q.", uniqUserList2[2].Email, member3.Email)
+	if uniqMembers2[2].Email != member3.Email {
+		t.Errorf("Uniq sort was incorrect, got: %q, want: %q.", uniqMembers2[2].Email, member3.Email)
 	}
 }
 
@@ -59,3 +70,311 @@ func getTestMembers() []*admin.Member {
 	fakeResult = append(fakeResult, fakeMember)
 	return fakeResult
 }
+
+// Starts a stand-in for the Directory API serving the given members of each group, pageSize members per page
+func newTestAdminService(t *testing.T, groups map[string][]*admin.Member, pageSize int) AdminService {
+	return newTestAdminServiceWithHandler(t, directoryHandler(groups, pageSize))
+}
+
+func newTestAdminServiceWithHandler(t *testing.T, handler http.Handler) AdminService {
+	server := testServer(t, handler)
+
+	service, err := admin.NewService(context.Background(), option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return AdminService{Service: service, MaxDepth: DefaultMaxGroupDepth}
+}
+
+func directoryHandler(groups map[string][]*admin.Member, pageSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/directory/v1/groups/"), "/members")
+		members, ok := groups[group]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		page := &admin.Members{}
+		page.Members, page.NextPageToken = testPage(members, r.URL.Query().Get("pageToken"), pageSize)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}
+}
+
+// Starts a stand-in for an API, closed when the test is done
+func testServer(t *testing.T, handler http.Handler) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Returns the page of items that starts at the offset given by token, and the token of the next page, as the stand-ins
+// for the paged APIs serve them. The token of the first page is empty, and so is the next token of the last page.
+func testPage[T any](items []T, token string, pageSize int) ([]T, string) {
+	start, _ := strconv.Atoi(token)
+	if start+pageSize >= len(items) {
+		return items[start:], ""
+	}
+	return items[start : start+pageSize], strconv.Itoa(start + pageSize)
+}
+
+// Responds with the given status to the first failures requests, and passes the rest on to next
+func failingHandler(failures int, status int, header http.Header, next http.Handler) (http.Handler, *atomic.Int32) {
+	var requests atomic.Int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= failures {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), &requests
+}
+
+func testMembers(prefix string, count int) (members []*admin.Member) {
+	for i := 0; i < count; i++ {
+		members = append(members, &admin.Member{Email: fmt.Sprintf("%s%d@test.com", prefix, i), Type: "USER"})
+	}
+	return
+}
+
+func TestToMembers(t *testing.T) {
+	members := toMembers([]*admin.Member{
+		{Email: "a@example.com", Type: "USER", Status: "ACTIVE"},
+		{Email: "b@example.com", Type: "USER", Status: "SUSPENDED"},
+		{Email: "robot@project.iam.gserviceaccount.com", Type: "USER", Status: "ACTIVE"},
+		{Email: "customer@example.com", Type: "CUSTOMER"},
+	})
+
+	assert.Equal(t, []Member{
+		{Email: "a@example.com", Type: MemberTypeUser, Status: MemberStatusActive},
+		{Email: "b@example.com", Type: MemberTypeUser, Status: MemberStatusSuspended},
+		{Email: "robot@project.iam.gserviceaccount.com", Type: MemberTypeServiceAccount, Status: MemberStatusActive},
+		{Email: "customer@example.com", Type: "CUSTOMER"},
+	}, members)
+}
+
+func TestAdminServicePagination(t *testing.T) {
+	t.Run("gets members from all pages", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"team@test.com": testMembers("user", 5),
+		}, 2)
+
+		members, err := service.getMembers(context.Background(), "team@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 5)
+		assert.Equal(t, "user4@test.com", members[4].Email)
+	})
+
+	t.Run("gets members from all pages of nested groups", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"team@test.com":   append(testMembers("user", 3), &admin.Member{Email: "nested@test.com", Type: "GROUP"}),
+			"nested@test.com": testMembers("nested", 5),
+		}, 2)
+
+		members, err := service.getMembers(context.Background(), "team@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 8)
+		assert.Contains(t, emails(members), "nested4@test.com")
+	})
+
+	t.Run("fails when group does not exist", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{}, 2)
+
+		_, err := service.getMembers(context.Background(), "team@test.com", LookupOptions{})
+		assert.Error(t, err)
+		assert.True(t, isGroupNotFound(err))
+	})
+}
+
+func TestAdminServiceNestedGroups(t *testing.T) {
+	group := func(email string) *admin.Member {
+		return &admin.Member{Email: email, Type: "GROUP"}
+	}
+
+	t.Run("stops expanding groups that contain each other", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com": append(testMembers("a", 2), group("b@test.com")),
+			"b@test.com": append(testMembers("b", 2), group("a@test.com")),
+		}, 10)
+
+		members, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"a0@test.com", "a1@test.com", "b0@test.com", "b1@test.com"}, emails(members))
+	})
+
+	t.Run("fails when groups are nested deeper than max depth", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com": {group("b@test.com")},
+			"b@test.com": {group("c@test.com")},
+			"c@test.com": testMembers("c", 1),
+		}, 10)
+		service.MaxDepth = 1
+
+		_, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.Error(t, err)
+
+		service.MaxDepth = 2
+		members, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c0@test.com"}, emails(members))
+	})
+
+	t.Run("reports errors from nested groups", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com": append(testMembers("a", 1), group("missing@test.com")),
+		}, 10)
+
+		_, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.ErrorContains(t, err, "missing@test.com")
+		assert.False(t, isGroupNotFound(err), "the group itself exists")
+	})
+
+	t.Run("members of nested groups get the role of the group", func(t *testing.T) {
+		managers := group("managers@test.com")
+		managers.Role = MemberRoleManager
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com": {
+				{Email: "owner@test.com", Type: "USER", Role: MemberRoleOwner},
+				{Email: "member@test.com", Type: "USER", Role: MemberRoleMember},
+				managers,
+			},
+			"managers@test.com": {
+				{Email: "member@test.com", Type: "USER", Role: MemberRoleOwner},
+				{Email: "owner@test.com", Type: "USER", Role: MemberRoleMember},
+			},
+		}, 10)
+
+		members, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "owner@test.com", Type: MemberTypeUser, Role: MemberRoleOwner},
+			{Email: "member@test.com", Type: MemberTypeUser, Role: MemberRoleManager},
+		}, members)
+	})
+
+	t.Run("groups reached by several paths are expanded for each of them", func(t *testing.T) {
+		owners, members := group("owners@test.com"), group("members@test.com")
+		owners.Role, members.Role = MemberRoleOwner, MemberRoleMember
+		shared := group("shared@test.com")
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com":       {members, owners},
+			"members@test.com": {shared},
+			"owners@test.com":  {shared},
+			"shared@test.com":  {{Email: "user@test.com", Type: "USER"}},
+		}, 10)
+
+		result, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{{Email: "user@test.com", Type: MemberTypeUser, Role: MemberRoleOwner}}, result)
+	})
+
+	t.Run("lists groups reached by several paths once", func(t *testing.T) {
+		shared := group("shared@test.com")
+		handler := directoryHandler(map[string][]*admin.Member{
+			"a@test.com":      {group("b@test.com"), group("c@test.com")},
+			"b@test.com":      {shared},
+			"c@test.com":      {shared},
+			"shared@test.com": testMembers("shared", 1),
+		}, 10)
+		requests := map[string]int{}
+		service := newTestAdminServiceWithHandler(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests[r.URL.Path]++
+			handler(w, r)
+		}))
+
+		_, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, requests["/admin/directory/v1/groups/shared@test.com/members"])
+	})
+
+	t.Run("keeps nested groups as groups when asked to", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com": append(testMembers("a", 1), group("b@test.com")),
+		}, 10)
+
+		members, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{IncludeGroups: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{{Email: "a0@test.com", Type: MemberTypeUser}, {Email: "b@test.com", Type: MemberTypeGroup}}, members)
+	})
+
+	t.Run("only gets direct members when asked to", func(t *testing.T) {
+		service := newTestAdminService(t, map[string][]*admin.Member{
+			"a@test.com": append(testMembers("a", 2), group("b@test.com")),
+			"b@test.com": testMembers("b", 2),
+		}, 10)
+
+		members, err := service.getMembers(context.Background(), "a@test.com", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a0@test.com", "a1@test.com"}, emails(members))
+	})
+}
+
+func TestAdminServiceRetries(t *testing.T) {
+	ctx := context.Background()
+	groups := map[string][]*admin.Member{"team@test.com": testMembers("user", 3)}
+	retry := RetryConfig{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+
+	t.Run("retries rate limited calls", func(t *testing.T) {
+		handler, requests := failingHandler(2, http.StatusTooManyRequests, nil, directoryHandler(groups, 2))
+		service := newTestAdminServiceWithHandler(t, handler)
+		service.Retry = retry
+
+		members, err := service.getMembers(ctx, "team@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 3)
+		assert.Equal(t, int32(4), requests.Load(), "two failed and two successful pages")
+	})
+
+	t.Run("retries server errors until max retries", func(t *testing.T) {
+		handler, requests := failingHandler(10, http.StatusServiceUnavailable, nil, directoryHandler(groups, 2))
+		service := newTestAdminServiceWithHandler(t, handler)
+		service.Retry = retry
+
+		_, err := service.getMembers(ctx, "team@test.com", LookupOptions{})
+		assert.Error(t, err)
+		assert.Equal(t, int32(4), requests.Load(), "first attempt and three retries")
+	})
+
+	t.Run("does not retry client errors", func(t *testing.T) {
+		handler, requests := failingHandler(1, http.StatusForbidden, nil, directoryHandler(groups, 2))
+		service := newTestAdminServiceWithHandler(t, handler)
+		service.Retry = retry
+
+		_, err := service.getMembers(ctx, "team@test.com", LookupOptions{})
+		assert.Error(t, err)
+		assert.Equal(t, int32(1), requests.Load())
+	})
+
+	t.Run("honours retry-after", func(t *testing.T) {
+		handler, _ := failingHandler(1, http.StatusTooManyRequests, http.Header{"Retry-After": {"1"}}, directoryHandler(groups, 10))
+		service := newTestAdminServiceWithHandler(t, handler)
+		service.Retry = RetryConfig{MaxRetries: 3, BaseDelay: time.Millisecond, MaxDelay: 2 * time.Second}
+
+		start := time.Now()
+		_, err := service.getMembers(ctx, "team@test.com", LookupOptions{})
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), time.Second)
+	})
+
+	t.Run("times out slow calls", func(t *testing.T) {
+		slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		})
+		service := newTestAdminServiceWithHandler(t, slow)
+		service.Timeout = 10 * time.Millisecond
+
+		start := time.Now()
+		_, err := service.getMembers(ctx, "team@test.com", LookupOptions{})
+		assert.Error(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Matching rule of Active Directory that walks the chain of nested groups
+	LDAPMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+	ldapPageSize            = 500
+	ldapAccountDisable      = 0x2
+)
+
+// Resolves members of Active Directory groups over LDAP(S). Groups are given by distinguished name, or by cn or
+// mail address under BaseDN. Nested groups are expanded by the server with LDAP_MATCHING_RULE_IN_CHAIN.
+type LDAPService struct {
+	// ldap:// or ldaps:// URL of the directory server
+	URL          string
+	BindDN       string
+	BindPassword string
+	// Where to search for groups and users
+	BaseDN string
+	// The user attribute used as subject name: mail, userPrincipalName or sAMAccountName
+	SubjectAttribute string
+	// Upgrade ldap:// connections with StartTLS
+	StartTLS  bool
+	TLSConfig *tls.Config
+	// The timeout applies to connecting and to each request to the directory server, and lookups are retried when
+	// they fail with a network error or because the server was busy or unavailable
+	CallConfig
+}
+
+func NewLDAPService(url, bindDN, bindPassword, baseDN string) *LDAPService {
+	return &LDAPService{
+		URL:              url,
+		BindDN:           bindDN,
+		BindPassword:     bindPassword,
+		BaseDN:           baseDN,
+		SubjectAttribute: "mail",
+		TLSConfig:        &tls.Config{},
+		CallConfig:       DefaultCallConfig,
+	}
+}
+
+// Trusts the certificates in the given PEM file, instead of the system roots, when connecting with TLS
+func (l *LDAPService) loadCAFile(caFile string) error {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("unable to read CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates in CA file %s", caFile)
+	}
+
+	l.TLSConfig.RootCAs = pool
+	return nil
+}
+
+func (l *LDAPService) String() string {
+	return fmt.Sprintf("LDAP %s (base DN: %s, subject attribute: %s, StartTLS: %t)", l.URL, l.BaseDN, l.SubjectAttribute, l.StartTLS)
+}
+
+// Gets the users that are members of a group, directly or through nested groups unless only direct members are asked for
+func (l *LDAPService) getMembers(ctx context.Context, group string, options LookupOptions) ([]Member, error) {
+	var members []Member
+	err := l.Retry.do(ctx, "ldap-get-members", func() (err error) {
+		members, err = l.lookupMembers(ctx, group, options)
+		return err
+	})
+	if err != nil {
+		promErrors.WithLabelValues("get-members").Inc()
+		return nil, fmt.Errorf("unable to get members: %w", err)
+	}
+
+	return members, nil
+}
+
+func (l *LDAPService) lookupMembers(ctx context.Context, group string, options LookupOptions) ([]Member, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	conn, err := l.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	groupDN, err := l.groupDN(conn, group)
+	if err != nil {
+		return nil, err
+	}
+
+	memberOf := fmt.Sprintf("(memberOf:%s:=%s)", LDAPMatchingRuleInChain, ldap.EscapeFilter(groupDN))
+	if options.DirectMembersOnly {
+		memberOf = fmt.Sprintf("(memberOf=%s)", ldap.EscapeFilter(groupDN))
+	}
+
+	users, err := l.search(conn, fmt.Sprintf("(&(objectClass=user)%s)", memberOf), l.SubjectAttribute, "userAccountControl")
+	if err != nil {
+		return nil, err
+	}
+
+	var members []Member
+	for _, user := range users {
+		subject := user.GetEqualFoldAttributeValue(l.SubjectAttribute)
+		if subject == "" {
+			log.Warnf("member %s of group %s has no %s, skipping", user.DN, group, l.SubjectAttribute)
+			continue
+		}
+		members = append(members, Member{Email: subject, Type: MemberTypeUser, Status: accountStatus(user)})
+	}
+
+	return members, nil
+}
+
+// Active Directory disables accounts with the ACCOUNTDISABLE flag of userAccountControl
+func accountStatus(user *ldap.Entry) string {
+	flags, err := strconv.Atoi(user.GetEqualFoldAttributeValue("userAccountControl"))
+	if err != nil {
+		return ""
+	}
+	if flags&ldapAccountDisable != 0 {
+		return MemberStatusSuspended
+	}
+	return MemberStatusActive
+}
+
+func (l *LDAPService) connect() (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: l.Timeout}
+	conn, err := ldap.DialURL(l.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(l.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(l.Timeout)
+	if l.StartTLS {
+		if err := conn.StartTLS(l.TLSConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Returns the distinguished name of a group given by distinguished name, cn or mail address
+func (l *LDAPService) groupDN(conn *ldap.Conn, group string) (string, error) {
+	if _, err := ldap.ParseDN(group); err == nil && strings.Contains(group, "=") {
+		return group, nil
+	}
+
+	filter := fmt.Sprintf("(&(objectClass=group)(|(cn=%s)(mail=%s)))", ldap.EscapeFilter(group), ldap.EscapeFilter(group))
+	groups, err := l.search(conn, filter, "1.1")
+	if err != nil {
+		return "", err
+	}
+
+	switch len(groups) {
+	case 0:
+		return "", &GroupNotFoundError{Group: fmt.Sprintf("%s in %s", group, l.BaseDN)}
+	case 1:
+		return groups[0].DN, nil
+	default:
+		return "", fmt.Errorf("%d groups named %s in %s", len(groups), group, l.BaseDN)
+	}
+}
+
+func (l *LDAPService) search(conn *ldap.Conn, filter string, attributes ...string) ([]*ldap.Entry, error) {
+	request := ldap.NewSearchRequest(l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, filter, attributes, nil)
+	result, err := conn.SearchWithPaging(request, ldapPageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Entries, nil
+}
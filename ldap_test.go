@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testBindDN   = "cn=rbac-sync,ou=services,dc=example,dc=com"
+	testPassword = "secret"
+	testGroupDN  = "cn=team,ou=groups,dc=example,dc=com"
+)
+
+// In-process LDAP server answering simple binds, and searches by filter from a fixed set of results. Results are
+// returned pageSize entries at a time, and the first busy searches fail as if the server was busy.
+type testLDAPServer struct {
+	results  map[string][]*ldap.Entry
+	pageSize int
+	busy     int32
+	binds    atomic.Int32
+	searches atomic.Int32
+	listener net.Listener
+}
+
+func newTestLDAPServer(t *testing.T, results map[string][]*ldap.Entry, pageSize int) *testLDAPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &testLDAPServer{results: results, pageSize: pageSize, listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return server
+}
+
+func (s *testLDAPServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		request, err := ber.ReadPacket(conn)
+		if err != nil || len(request.Children) < 2 {
+			return
+		}
+
+		messageID := request.Children[0].Value.(int64)
+		op := request.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			s.binds.Add(1)
+			code := uint16(ldap.LDAPResultSuccess)
+			if op.Children[1].Value.(string) != testBindDN || op.Children[2].Data.String() != testPassword {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			conn.Write(ldapMessage(messageID, ldapResult(ldap.ApplicationBindResponse, code)).Bytes())
+		case ldap.ApplicationSearchRequest:
+			s.search(conn, messageID, op, request)
+		default:
+			return
+		}
+	}
+}
+
+func (s *testLDAPServer) search(conn net.Conn, messageID int64, op, request *ber.Packet) {
+	if s.searches.Add(1) <= s.busy {
+		conn.Write(ldapMessage(messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultBusy)).Bytes())
+		return
+	}
+
+	filter, err := ldap.DecompileFilter(op.Children[6])
+	if err != nil {
+		conn.Write(ldapMessage(messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)).Bytes())
+		return
+	}
+
+	var paging *ldap.ControlPaging
+	if len(request.Children) > 2 {
+		for _, child := range request.Children[2].Children {
+			if control, err := ldap.DecodeControl(child); err == nil && control.GetControlType() == ldap.ControlTypePaging {
+				paging = control.(*ldap.ControlPaging)
+			}
+		}
+	}
+
+	entries := s.results[filter]
+	start, end := 0, len(entries)
+	if paging != nil {
+		start, _ = strconv.Atoi(string(paging.Cookie))
+		if start+s.pageSize < end {
+			end = start + s.pageSize
+		}
+	}
+
+	for _, entry := range entries[start:end] {
+		conn.Write(ldapMessage(messageID, ldapEntry(entry)).Bytes())
+	}
+
+	done := ldapMessage(messageID, ldapResult(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+	if paging != nil {
+		next := ldap.NewControlPaging(uint32(s.pageSize))
+		if end < len(entries) {
+			next.SetCookie([]byte(strconv.Itoa(end)))
+		}
+		controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+		controls.AppendChild(next.Encode())
+		done.AppendChild(controls)
+	}
+	conn.Write(done.Bytes())
+}
+
+func ldapMessage(messageID int64, op *ber.Packet) *ber.Packet {
+	message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "Message ID"))
+	message.AppendChild(op)
+	return message
+}
+
+func ldapResult(application ber.Tag, code uint16) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, application, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return result
+}
+
+func ldapEntry(entry *ldap.Entry) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, attribute := range entry.Attributes {
+		packetAttribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		packetAttribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, attribute.Name, "Type"))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range attribute.Values {
+			values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		packetAttribute.AppendChild(values)
+		attributes.AppendChild(packetAttribute)
+	}
+	packet.AppendChild(attributes)
+
+	return packet
+}
+
+func testLDAPUser(name string) *ldap.Entry {
+	return ldap.NewEntry("cn="+name+",ou=users,dc=example,dc=com", map[string][]string{
+		"mail":              {name + "@example.com"},
+		"userPrincipalName": {name + "@corp.example.com"},
+		"sAMAccountName":    {name},
+	})
+}
+
+func newTestLDAPService(server *testLDAPServer) *LDAPService {
+	service := NewLDAPService(server.URL(), testBindDN, testPassword, "dc=example,dc=com")
+	service.Timeout = 5 * time.Second
+	service.Retry.BaseDelay = time.Millisecond
+	return service
+}
+
+func TestLDAPService(t *testing.T) {
+	ctx := context.Background()
+	withoutMail := ldap.NewEntry("cn=d,ou=users,dc=example,dc=com", map[string][]string{"sAMAccountName": {"d"}})
+	server := newTestLDAPServer(t, map[string][]*ldap.Entry{
+		"(&(objectClass=group)(|(cn=team)(mail=team)))":                         {ldap.NewEntry(testGroupDN, nil)},
+		"(&(objectClass=group)(|(cn=team@example.com)(mail=team@example.com)))": {ldap.NewEntry(testGroupDN, nil)},
+		"(&(objectClass=user)(memberOf:1.2.840.113556.1.4.1941:=" + testGroupDN + "))": {
+			testLDAPUser("a"), testLDAPUser("b"), withoutMail, testLDAPUser("c"),
+		},
+		"(&(objectClass=user)(memberOf=" + testGroupDN + "))": {testLDAPUser("a")},
+	}, 2)
+
+	t.Run("nested members of group by cn, across pages", func(t *testing.T) {
+		members, err := newTestLDAPService(server).getMembers(ctx, "team", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com", "b@example.com", "c@example.com"}, emails(members))
+	})
+
+	t.Run("group by mail and distinguished name", func(t *testing.T) {
+		service := newTestLDAPService(server)
+		byMail, err := service.getMembers(ctx, "team@example.com", LookupOptions{})
+		assert.NoError(t, err)
+		byDN, err := service.getMembers(ctx, testGroupDN, LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, byMail, byDN)
+		assert.Len(t, byDN, 3)
+	})
+
+	t.Run("direct members only", func(t *testing.T) {
+		members, err := newTestLDAPService(server).getMembers(ctx, "team", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@example.com"}, emails(members))
+	})
+
+	t.Run("subject attribute", func(t *testing.T) {
+		service := newTestLDAPService(server)
+		service.SubjectAttribute = "sAMAccountName"
+		members, err := service.getMembers(ctx, "team", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "d", "c"}, emails(members))
+
+		service.SubjectAttribute = "userPrincipalName"
+		members, err = service.getMembers(ctx, "team", LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a@corp.example.com"}, emails(members))
+	})
+
+	t.Run("disabled accounts are suspended", func(t *testing.T) {
+		disabled := testLDAPUser("e")
+		disabled.Attributes = append(disabled.Attributes, ldap.NewEntryAttribute("userAccountControl", []string{"514"}))
+		enabled := testLDAPUser("f")
+		enabled.Attributes = append(enabled.Attributes, ldap.NewEntryAttribute("userAccountControl", []string{"512"}))
+		server := newTestLDAPServer(t, map[string][]*ldap.Entry{
+			"(&(objectClass=user)(memberOf=" + testGroupDN + "))": {disabled, enabled, testLDAPUser("g")},
+		}, 10)
+
+		members, err := newTestLDAPService(server).getMembers(ctx, testGroupDN, LookupOptions{DirectMembersOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []Member{
+			{Email: "e@example.com", Type: MemberTypeUser, Status: MemberStatusSuspended},
+			{Email: "f@example.com", Type: MemberTypeUser, Status: MemberStatusActive},
+			{Email: "g@example.com", Type: MemberTypeUser},
+		}, members)
+	})
+
+	t.Run("unknown group", func(t *testing.T) {
+		_, err := newTestLDAPService(server).getMembers(ctx, "unknown", LookupOptions{})
+		assert.Error(t, err)
+	})
+
+	t.Run("invalid credentials are not retried", func(t *testing.T) {
+		service := newTestLDAPService(server)
+		service.BindPassword = "wrong"
+		binds := server.binds.Load()
+
+		_, err := service.getMembers(ctx, "team", LookupOptions{})
+		assert.ErrorContains(t, err, "Invalid Credentials")
+		assert.Equal(t, binds+1, server.binds.Load())
+	})
+
+	t.Run("busy server is retried", func(t *testing.T) {
+		busy := newTestLDAPServer(t, server.results, 2)
+		busy.busy = 2
+
+		members, err := newTestLDAPService(busy).getMembers(ctx, "team", LookupOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, members, 3)
+	})
+}
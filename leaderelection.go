@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+type LeaderElectionConfig struct {
+	LeaseName     string
+	Namespace     string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+}
+
+func (c LeaderElectionConfig) String() string {
+	return fmt.Sprintf("lease: %s/%s, identity: %s, lease duration: %s, renew deadline: %s, retry period: %s",
+		c.Namespace, c.LeaseName, c.Identity, c.LeaseDuration, c.RenewDeadline, c.RetryPeriod)
+}
+
+// Blocks until this instance holds the leader lease, then calls run with a channel that is closed when ctx is
+// cancelled or the lease is lost. The lease is released only after run has returned, so that the next leader
+// never writes role bindings concurrently with this one.
+func runWithLeaderElection(ctx context.Context, clientSet kubernetes.Interface, config LeaderElectionConfig, run func(stopCh <-chan struct{})) error {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      config.LeaseName,
+			Namespace: config.Namespace,
+		},
+		Client: clientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: config.Identity,
+		},
+	}
+
+	// The election has its own context, as cancelling it releases the lease
+	electionCtx, cancelElection := context.WithCancel(context.Background())
+	defer cancelElection()
+
+	var leading atomic.Bool
+	go func() {
+		<-ctx.Done()
+		if !leading.Load() {
+			cancelElection()
+		}
+	}()
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		Name:            config.LeaseName,
+		LeaseDuration:   config.LeaseDuration,
+		RenewDeadline:   config.RenewDeadline,
+		RetryPeriod:     config.RetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(leaderCtx context.Context) {
+				defer cancelElection()
+				leading.Store(true)
+				ready.Store(true)
+				promLeader.Set(1)
+				log.Infof("acquired leader lease %s/%s", config.Namespace, config.LeaseName)
+
+				stopCh := make(chan struct{})
+				go func() {
+					select {
+					case <-ctx.Done():
+					case <-leaderCtx.Done():
+					}
+					close(stopCh)
+				}()
+
+				run(stopCh)
+			},
+			OnStoppedLeading: func() {
+				ready.Store(false)
+				promLeader.Set(0)
+				if !leading.Load() {
+					return
+				}
+				if ctx.Err() == nil {
+					promErrors.WithLabelValues("leader-election").Inc()
+					log.Fatalf("lost leader lease %s/%s", config.Namespace, config.LeaseName)
+				}
+				log.Infof("stopped leading, lease %s/%s released", config.Namespace, config.LeaseName)
+			},
+			OnNewLeader: func(identity string) {
+				if identity != config.Identity {
+					log.Infof("current leader is %s", identity)
+				}
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create leader elector: %s", err)
+	}
+
+	elector.Run(electionCtx)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLeaderElection(t *testing.T) {
+	clientSet := fake.NewSimpleClientset()
+	config := LeaderElectionConfig{
+		LeaseName:     "rbac-sync",
+		Namespace:     "nais-system",
+		Identity:      "rbac-sync-1",
+		LeaseDuration: 15 * time.Second,
+		RenewDeadline: 10 * time.Second,
+		RetryPeriod:   100 * time.Millisecond,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		err := runWithLeaderElection(ctx, clientSet, config, func(stopCh <-chan struct{}) {
+			close(started)
+			<-stopCh
+			close(stopped)
+		})
+		assert.NoError(t, err)
+	}()
+
+	t.Run("runs and becomes ready when holding the lease", func(t *testing.T) {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("never started leading")
+		}
+		assert.True(t, ready.Load())
+		assert.Equal(t, float64(1), testutil.ToFloat64(promLeader))
+
+		lease, err := clientSet.CoordinationV1().Leases("nais-system").Get(context.Background(), "rbac-sync", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "rbac-sync-1", *lease.Spec.HolderIdentity)
+	})
+
+	t.Run("stops and releases the lease when cancelled", func(t *testing.T) {
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("leader election did not return")
+		}
+		assert.False(t, ready.Load())
+		assert.Equal(t, float64(0), testutil.ToFloat64(promLeader))
+
+		select {
+		case <-stopped:
+		default:
+			t.Fatal("run did not return before the lease was released")
+		}
+
+		lease, err := clientSet.CoordinationV1().Leases("nais-system").Get(context.Background(), "rbac-sync", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, *lease.Spec.HolderIdentity)
+	})
+}
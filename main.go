@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	"k8s.io/client-go/rest"
@@ -10,6 +12,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,12 +26,53 @@ var (
 	kubeconfig               string
 	serviceAccountKeyFile    string
 	gcpAdminUser             string
+	gcpServiceAccount        string
+	authMode                 string
+	iamProvider              string
+	azureTenantID            string
+	azureClientID            string
+	azureClientSecret        string
+	ldapURL                  string
+	ldapBindDN               string
+	ldapBindPassword         string
+	ldapBaseDN               string
+	ldapSubjectAttribute     string
+	ldapStartTLS             bool
+	ldapCAFile               string
+	gitHubURL                string
+	gitHubToken              string
+	groupsFile               string
+	groupsConfigMap          string
+	groupsConfigMapKey       string
+	groupsReloadInterval     time.Duration
+	keyFileReloadInterval    time.Duration
 	updateInterval           time.Duration
+	workers                  int
+	maxGroupDepth            int
+	groupCacheTTL            time.Duration
+	iamTimeout               time.Duration
+	iamMaxRetries            int
+	groupCacheMaxStale       time.Duration
 	bindAddress              string
 	defaultRoles             string
 	defaultRolebindingPrefix string
 	mockIAM                  bool
 	debug                    bool
+	dryRun                   bool
+	memberStatuses           string
+	memberTypes              string
+	memberDomains            string
+	memberRoles              string
+	subjectMode              string
+	userSubjectTemplates     = subjectTemplateFlag{}
+	groupSubjectTemplates    = subjectTemplateFlag{}
+	groupBindings            bool
+	groupBindingAllowedRoles string
+	emptyMissingGroups       bool
+	output                   string
+	leaderElect              bool
+	leaderElection           LeaderElectionConfig
+	ready                    atomic.Bool
 	promSuccess              = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name:      "successes",
@@ -42,25 +87,212 @@ var (
 			Help:      "Cumulative number of failed operations"},
 		[]string{"operation"},
 	)
+	promStale = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "stale_namespace",
+			Namespace: "rbac_sync",
+			Help:      "Set to 1 for namespaces where the group lookup failed and existing role bindings are kept"},
+		[]string{"namespace"},
+	)
+	promPlanned = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "planned_changes",
+			Namespace: "rbac_sync",
+			Help:      "Number of role binding changes planned in dry run mode"},
+		[]string{"namespace", "operation"},
+	)
+	promRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "retries",
+			Namespace: "rbac_sync",
+			Help:      "Cumulative number of retried operations"},
+		[]string{"operation"},
+	)
+	promCredentialReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "credential_reloads",
+			Namespace: "rbac_sync",
+			Help:      "Cumulative number of service account key reloads by result (success or failure)"},
+		[]string{"result"},
+	)
+	promProviderLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "provider_lookups",
+			Namespace: "rbac_sync",
+			Help:      "Cumulative number of group member lookups by provider and result (success or error)"},
+		[]string{"provider", "result"},
+	)
+	promFilteredMembers = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "filtered_members",
+			Namespace: "rbac_sync",
+			Help:      "Number of group members left out of the role bindings of a namespace by reason (status, type or domain)"},
+		[]string{"namespace", "reason"},
+	)
+	promLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "leader",
+			Namespace: "rbac_sync",
+			Help:      "Set to 1 on the replica that synchronizes role bindings, and 0 on replicas waiting for the leader lease"},
+	)
+	promCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "group_cache_lookups",
+			Namespace: "rbac_sync",
+			Help:      "Cumulative number of group member lookups in the cache by result (hit, miss or stale)"},
+		[]string{"result"},
+	)
 )
 
 func main() {
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "path to Kubernetes config file")
-	flag.StringVar(&serviceAccountKeyFile, "serviceaccount-keyfile", "", "The path to the service account private key file.")
+	flag.StringVar(&serviceAccountKeyFile, "serviceaccount-keyfile", "", "The path to the service account private key file. Optional for cloudidentity, which defaults to Application Default Credentials.")
+	flag.DurationVar(&keyFileReloadInterval, "serviceaccount-keyfile-reload-interval", time.Minute, "How often to check the service account key file for a new key. 0 disables reloading.")
 	flag.StringVar(&gcpAdminUser, "gcp-admin-user", "", "The google admin user e-mail address.")
+	flag.StringVar(&authMode, "auth-mode", AuthModeKeyFile, "How to authenticate to Google Admin: keyfile uses -serviceaccount-keyfile, workload-identity signs with Application Default Credentials.")
+	flag.StringVar(&gcpServiceAccount, "gcp-service-account", "", "The service account with domain wide delegation, in workload-identity auth mode. Defaults to the service account of the metadata server.")
+	flag.StringVar(&iamProvider, "iam-provider", ProviderGoogle, "Where to look up group members, comma-separated: google (Google Workspace Admin SDK), cloudidentity (Cloud Identity Groups API), azure (Microsoft Entra ID), ldap (Active Directory), github (GitHub teams) or file (YAML file or ConfigMap). Groups are routed by a <provider>: prefix, and go to google, or the first provider, without one.")
+	flag.StringVar(&azureTenantID, "azure-tenant-id", "", "The Microsoft Entra ID tenant, in azure provider.")
+	flag.StringVar(&azureClientID, "azure-client-id", "", "The client id of the app registration used to read groups, in azure provider.")
+	flag.StringVar(&azureClientSecret, "azure-client-secret", "", "The client secret of the app registration, in azure provider. Defaults to $AZURE_CLIENT_SECRET.")
+	flag.StringVar(&ldapURL, "ldap-url", "", "URL of the directory server, ldap:// or ldaps://, in ldap provider.")
+	flag.StringVar(&ldapBindDN, "ldap-bind-dn", "", "Distinguished name to bind as, in ldap provider.")
+	flag.StringVar(&ldapBindPassword, "ldap-bind-password", "", "Password to bind with, in ldap provider. Defaults to $LDAP_BIND_PASSWORD.")
+	flag.StringVar(&ldapBaseDN, "ldap-base-dn", "", "Where to search for groups and users, in ldap provider.")
+	flag.StringVar(&ldapSubjectAttribute, "ldap-subject-attribute", "mail", "User attribute used as role binding subject, in ldap provider: mail, userPrincipalName or sAMAccountName.")
+	flag.BoolVar(&ldapStartTLS, "ldap-start-tls", false, "Upgrade ldap:// connections with StartTLS, in ldap provider.")
+	flag.StringVar(&ldapCAFile, "ldap-ca-file", "", "PEM file with the CA certificates to trust for LDAPS and StartTLS, in ldap provider. Defaults to the system roots.")
+	flag.StringVar(&gitHubURL, "github-url", GitHubURL, "The GitHub API URL, https://<host>/api for GitHub Enterprise Server, in github provider.")
+	flag.StringVar(&gitHubToken, "github-token", "", "Token that may read the organization's teams (read:org), in github provider. Defaults to $GITHUB_TOKEN.")
+	flag.StringVar(&groupsFile, "groups-file", "", "YAML file with groups and their members, in file provider.")
+	flag.StringVar(&groupsConfigMap, "groups-configmap", "", "ConfigMap with groups and their members, as <namespace>/<name>, in file provider.")
+	flag.StringVar(&groupsConfigMapKey, "groups-configmap-key", DefaultGroupsConfigMapKey, "Key of the groups in the ConfigMap, in file provider.")
+	flag.DurationVar(&groupsReloadInterval, "groups-reload-interval", 10*time.Second, "How often to check the groups file or ConfigMap for changes, in file provider. 0 disables reloading.")
 	flag.StringVar(&bindAddress, "bind-address", ":8080", "Bind address for application.")
-	flag.DurationVar(&updateInterval, "update-interval", time.Minute*5, "Update interval in seconds.")
+	flag.DurationVar(&updateInterval, "update-interval", time.Minute*5, "Interval between full resyncs of IAM group membership.")
+	flag.IntVar(&workers, "workers", 2, "Number of namespaces to synchronize concurrently.")
+	flag.IntVar(&maxGroupDepth, "max-group-depth", DefaultMaxGroupDepth, "Maximum number of levels of nested groups to expand.")
+	flag.DurationVar(&iamTimeout, "iam-timeout", 30*time.Second, "Timeout of each call to the IAM API.")
+	flag.IntVar(&iamMaxRetries, "iam-max-retries", DefaultRetryConfig.MaxRetries, "How many times to retry IAM API calls that were rate limited or failed with a server error.")
+	flag.DurationVar(&groupCacheTTL, "group-cache-ttl", time.Minute, "How long group members are cached. 0 disables the cache.")
+	flag.DurationVar(&groupCacheMaxStale, "group-cache-max-stale", time.Hour, "How long cached group members are used after the TTL while they are refreshed in the background, or when refreshing them fails.")
 	flag.StringVar(&defaultRoles, "default-roles", "rbacsync-default", "Default role(s) if not specified in namespace annotation. Comma-separated")
 	flag.StringVar(&defaultRolebindingPrefix, "default-rolebinding-prefix", "rbacsync-default", "Default rolebinding-prefix if not specified in namespace annotation, rolebinding name format will be <prefix>-<role>")
+	flag.StringVar(&memberStatuses, "member-statuses", "", "Member statuses to bind, comma-separated, e.g. ACTIVE. Empty binds any status. Overridden by the "+MemberStatusesAnnotation+" namespace annotation.")
+	flag.StringVar(&memberTypes, "member-types", "", "Member types to bind, comma-separated, e.g. USER,SERVICE_ACCOUNT. Empty binds any type. Overridden by the "+MemberTypesAnnotation+" namespace annotation.")
+	flag.StringVar(&memberDomains, "member-domains", "", "E-mail domains of members to bind, comma-separated. Empty binds any domain. Overridden by the "+MemberDomainsAnnotation+" namespace annotation.")
+	flag.StringVar(&memberRoles, "member-roles", "", "Default ClusterRoles by member role in the group, as comma-separated <OWNER|MANAGER|MEMBER|*>=<cluster role> pairs, e.g. OWNER=admin,*=view. Used instead of -default-roles unless a namespace names its roles, and overridden by the "+MemberRolesAnnotation+" namespace annotation.")
+	flag.StringVar(&subjectMode, "subject-mode", SubjectModeUser, "How to bind groups: user binds each member as a User, group binds the group itself as a Group (e.g. GKE Google Groups for RBAC), hybrid binds direct users as Users and nested groups as Groups. Overridden by the "+SubjectModeAnnotation+" namespace annotation.")
+	flag.Var(userSubjectTemplates, "user-subject-template", "Go `template` of the name of User subjects, e.g. oidc:{{ .Email | lower }}. Fields are .Email, .Type, .Status and .Role, and functions lower and upper. Given as <provider>=<template> for a single provider, and repeatable. Overridden by the "+UserSubjectTemplateAnnotation+" namespace annotation. (default "+DefaultSubjectTemplate+")")
+	flag.Var(groupSubjectTemplates, "group-subject-template", "Go `template` of the name of Group subjects, e.g. oidc:{{ .Email }}, where .Email is the group name. Given as <provider>=<template> for a single provider, and repeatable. Overridden by the "+GroupSubjectTemplateAnnotation+" namespace annotation. (default "+DefaultSubjectTemplate+")")
+	flag.BoolVar(&groupBindings, "group-bindings", false, "Also synchronize GroupBinding resources (groupbindings."+AnnotationNS+"), and report their status. Needs the GroupBinding CRD to be installed.")
+	flag.StringVar(&groupBindingAllowedRoles, "groupbinding-allowed-roles", "", "ClusterRoles that GroupBindings may bind, comma-separated. Empty allows the ClusterRoles of -default-roles and -member-roles only.")
+	flag.BoolVar(&emptyMissingGroups, "empty-missing-groups", false, "Bind no members for groups that the provider reports as not found, e.g. deleted groups, instead of keeping their role bindings as for a failed lookup. Some providers also answer not found when rbac-sync may not read the group.")
 	flag.BoolVar(&mockIAM, "mock-iam", false, "starts rbac-sync with a mocked version of the IAM client")
 	flag.BoolVar(&debug, "debug", false, "enables debug logging")
+	flag.BoolVar(&dryRun, "dry-run", false, "logs planned role binding changes without creating, updating or deleting anything")
+	flag.BoolVar(&leaderElect, "leader-elect", false, "Only synchronize when holding the leader lease. Required when running more than one replica.")
+	flag.StringVar(&leaderElection.LeaseName, "leader-election-lease-name", "rbac-sync", "Name of the lease used for leader election.")
+	flag.StringVar(&leaderElection.Namespace, "leader-election-namespace", "", "Namespace of the lease used for leader election.")
+	flag.DurationVar(&leaderElection.LeaseDuration, "leader-election-lease-duration", 15*time.Second, "Duration that followers wait before trying to acquire an unrenewed lease.")
+	flag.DurationVar(&leaderElection.RenewDeadline, "leader-election-renew-deadline", 10*time.Second, "Duration that the leader retries renewing the lease before giving it up.")
+	flag.DurationVar(&leaderElection.RetryPeriod, "leader-election-retry-period", 2*time.Second, "Duration between attempts to acquire or renew the lease.")
+
+	flag.StringVar(&output, "o", "text", "Output format of the plan command, text or json")
 
 	flag.Parse()
 
+	// Flags may be given both before and after the plan command
+	planCommand := flag.Arg(0) == "plan"
+	if planCommand {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	// Secrets are taken from the environment after parsing, so that the usage does not print them as defaults
+	azureClientSecret = ensureVal(azureClientSecret, os.Getenv("AZURE_CLIENT_SECRET"))
+	ldapBindPassword = ensureVal(ldapBindPassword, os.Getenv("LDAP_BIND_PASSWORD"))
+	gitHubToken = ensureVal(gitHubToken, os.Getenv("GITHUB_TOKEN"))
+
 	setupLogging()
 
-	if !mockIAM {
-		if serviceAccountKeyFile == "" {
+	providers := map[string]bool{}
+	var defaultProvider string
+	for _, provider := range strings.Split(iamProvider, ",") {
+		provider = strings.TrimSpace(provider)
+		if !isProvider(provider) && !mockIAM {
+			flag.Usage()
+			log.Fatalf("invalid configuration: -iam-provider must be one or more of %s", strings.Join(Providers, ", "))
+		}
+		if defaultProvider == "" {
+			defaultProvider = provider
+		}
+		providers[provider] = true
+	}
+
+	// Groups without a provider prefix go to Google, or to the first provider if Google is not used
+	if providers[ProviderGoogle] {
+		defaultProvider = ProviderGoogle
+	}
+
+	if !mockIAM && providers[ProviderFile] {
+		if (groupsFile == "") == (groupsConfigMap == "") {
+			flag.Usage()
+			log.Fatal("invalid configuration: the file provider needs one of -groups-file or -groups-configmap")
+		}
+		if groupsConfigMap != "" && len(strings.Split(groupsConfigMap, "/")) != 2 {
+			flag.Usage()
+			log.Fatal("invalid configuration: -groups-configmap must be <namespace>/<name>")
+		}
+	}
+
+	if !mockIAM && providers[ProviderGitHub] && gitHubToken == "" {
+		flag.Usage()
+		log.Fatal("missing configuration: -github-token is required by the github provider")
+	}
+
+	if !mockIAM && providers[ProviderAzure] {
+		if azureTenantID == "" || azureClientID == "" || azureClientSecret == "" {
+			flag.Usage()
+			log.Fatal("missing configuration: -azure-tenant-id, -azure-client-id and -azure-client-secret are required by the azure provider")
+		}
+	}
+
+	defaultMemberRoles, err := ParseRoleMapping(memberRoles)
+	if err != nil {
+		flag.Usage()
+		log.Fatalf("invalid configuration: -member-roles: %s", err)
+	}
+
+	if !isSubjectMode(subjectMode) {
+		flag.Usage()
+		log.Fatalf("invalid configuration: -subject-mode must be %s, %s or %s", SubjectModeUser, SubjectModeGroup, SubjectModeHybrid)
+	}
+
+	subjectTemplates, err := NewSubjectTemplatesByProvider(userSubjectTemplates, groupSubjectTemplates)
+	if err != nil {
+		flag.Usage()
+		log.Fatalf("invalid configuration: subject templates: %s", err)
+	}
+
+	if !mockIAM && providers[ProviderLDAP] {
+		if ldapURL == "" || ldapBaseDN == "" {
+			flag.Usage()
+			log.Fatal("missing configuration: -ldap-url and -ldap-base-dn are required by the ldap provider")
+		}
+		switch ldapSubjectAttribute {
+		case "mail", "userPrincipalName", "sAMAccountName":
+		default:
+			flag.Usage()
+			log.Fatal("invalid configuration: -ldap-subject-attribute must be mail, userPrincipalName or sAMAccountName")
+		}
+	}
+
+	if !mockIAM && providers[ProviderGoogle] {
+		if authMode != AuthModeKeyFile && authMode != AuthModeWorkloadIdentity {
+			flag.Usage()
+			log.Fatalf("invalid configuration: -auth-mode must be %s or %s", AuthModeKeyFile, AuthModeWorkloadIdentity)
+		}
+		if authMode == AuthModeKeyFile && serviceAccountKeyFile == "" {
 			flag.Usage()
 			log.Fatal("missing configuration: -serviceaccount-keyfile")
 		}
@@ -70,10 +302,10 @@ func main() {
 		}
 	}
 
-	stopChan := make(chan struct{}, 1)
-
-	go serve(bindAddress)
-	go handleSigterm(stopChan)
+	if leaderElect && leaderElection.Namespace == "" {
+		flag.Usage()
+		log.Fatal("missing configuration: -leader-election-namespace")
+	}
 
 	clientSet, error := getKubeClient()
 	if error != nil {
@@ -81,18 +313,148 @@ func main() {
 	}
 
 	var iamClient IAMClient
+	var credentials []*KeyFileCredentials
+	var fileService *FileService
 	if mockIAM {
 		iamClient = MockAdminService{}
 	} else {
-		iamClient, error = NewAdminService(serviceAccountKeyFile, gcpAdminUser)
-		if error != nil {
-			log.Fatal(error)
+		composite := NewCompositeIAMClient(defaultProvider)
+		callConfig := DefaultCallConfig
+		callConfig.Timeout = iamTimeout
+		callConfig.Retry.MaxRetries = iamMaxRetries
+		if providers[ProviderGoogle] {
+			var adminService *AdminService
+			if authMode == AuthModeWorkloadIdentity {
+				adminService, error = NewAdminServiceWithWorkloadIdentity(gcpServiceAccount, gcpAdminUser, iamTimeout)
+			} else {
+				adminService, error = NewAdminService(serviceAccountKeyFile, gcpAdminUser)
+			}
+			if error != nil {
+				log.Fatal(error)
+			}
+			adminService.MaxDepth = maxGroupDepth
+			adminService.CallConfig = callConfig
+			if adminService.Credentials != nil {
+				credentials = append(credentials, adminService.Credentials)
+			}
+			composite.Backends[ProviderGoogle] = adminService
+		}
+		if providers[ProviderCloudIdentity] {
+			cloudIdentityService, err := NewCloudIdentityService(serviceAccountKeyFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cloudIdentityService.CallConfig = callConfig
+			if cloudIdentityService.Credentials != nil {
+				credentials = append(credentials, cloudIdentityService.Credentials)
+			}
+			composite.Backends[ProviderCloudIdentity] = cloudIdentityService
 		}
+		if providers[ProviderAzure] {
+			graphService := NewGraphService(azureTenantID, azureClientID, azureClientSecret)
+			graphService.CallConfig = callConfig
+			log.Infof("looking up group members in %s", graphService)
+			composite.Backends[ProviderAzure] = graphService
+		}
+		if providers[ProviderLDAP] {
+			ldapService := NewLDAPService(ldapURL, ldapBindDN, ldapBindPassword, ldapBaseDN)
+			ldapService.SubjectAttribute = ldapSubjectAttribute
+			ldapService.StartTLS = ldapStartTLS
+			ldapService.CallConfig = callConfig
+			if ldapCAFile != "" {
+				if err := ldapService.loadCAFile(ldapCAFile); err != nil {
+					log.Fatal(err)
+				}
+			}
+			log.Infof("looking up group members in %s", ldapService)
+			composite.Backends[ProviderLDAP] = ldapService
+		}
+		if providers[ProviderGitHub] {
+			gitHubService := NewGitHubService(gitHubURL, gitHubToken)
+			gitHubService.CallConfig = callConfig
+			log.Infof("looking up group members in %s", gitHubService)
+			composite.Backends[ProviderGitHub] = gitHubService
+		}
+		if providers[ProviderFile] {
+			if groupsConfigMap != "" {
+				namespaceName := strings.Split(groupsConfigMap, "/")
+				fileService, error = NewConfigMapFileService(context.Background(), clientSet, namespaceName[0], namespaceName[1], groupsConfigMapKey)
+			} else {
+				fileService, error = NewFileService(context.Background(), groupsFile)
+			}
+			if error != nil {
+				log.Fatal(error)
+			}
+			fileService.MaxDepth = maxGroupDepth
+			composite.Backends[ProviderFile] = fileService
+		}
+		log.Infof("looking up group members with %s", composite)
+		iamClient = composite
+	}
+
+	if groupCacheTTL > 0 {
+		cache := NewCachingIAMClient(iamClient, groupCacheTTL, groupCacheMaxStale)
+		cache.EmptyMissingGroups = emptyMissingGroups
+		log.Infof("caching group members: %s", cache)
+		iamClient = cache
 	}
 
 	s := NewSynchronizer(clientSet, iamClient, updateInterval, gcpAdminUser, serviceAccountKeyFile, defaultRoles, defaultRolebindingPrefix)
-	log.Infof("starting RBAC synchronizer: %s", s)
-	s.synchronizeRBAC()
+	s.DryRun = dryRun
+	s.MemberFilter = NewMemberFilter(memberStatuses, memberTypes, memberDomains)
+	s.DefaultMemberRoles = defaultMemberRoles
+	s.SubjectMode = subjectMode
+	s.SubjectTemplates = subjectTemplates
+	s.DefaultProvider = defaultProvider
+	s.EmptyMissingGroups = emptyMissingGroups
+	s.GroupBindingAllowedRoles = splitList(groupBindingAllowedRoles)
+	if groupBindings {
+		if s.DynamicClient, error = getDynamicClient(); error != nil {
+			log.Fatalf("unable to get kubernetes client: %s", error)
+		}
+	}
+
+	if planCommand {
+		// Keep stdout for the plan itself
+		log.SetOutput(os.Stderr)
+		os.Exit(runPlan(context.Background(), s, output, os.Stdout))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go serve(bindAddress)
+	go handleSigterm(cancel)
+
+	if keyFileReloadInterval > 0 {
+		for _, c := range credentials {
+			go c.watch(ctx, keyFileReloadInterval)
+		}
+	}
+	if fileService != nil && groupsReloadInterval > 0 {
+		go fileService.watch(ctx, groupsReloadInterval)
+	}
+
+	run := func(stopCh <-chan struct{}) {
+		log.Infof("starting RBAC synchronizer: %s", s)
+		s.Run(stopCh, workers)
+	}
+
+	if !leaderElect {
+		ready.Store(true)
+		promLeader.Set(1)
+		run(ctx.Done())
+		return
+	}
+
+	leaderElection.Identity, error = os.Hostname()
+	if error != nil {
+		log.Fatalf("unable to get hostname for leader election identity: %s", error)
+	}
+
+	log.Infof("waiting for leader lease: %s", leaderElection)
+	if error = runWithLeaderElection(ctx, clientSet, leaderElection, run); error != nil {
+		log.Fatal(error)
+	}
 }
 
 func setupLogging() {
@@ -112,8 +474,27 @@ func serve(address string) {
 		w.Write([]byte("OK"))
 	})
 
+	// Only the instance that synchronizes role bindings is ready
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not leader"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
 	prometheus.MustRegister(promSuccess)
 	prometheus.MustRegister(promErrors)
+	prometheus.MustRegister(promStale)
+	prometheus.MustRegister(promLeader)
+	prometheus.MustRegister(promPlanned)
+	prometheus.MustRegister(promCacheLookups)
+	prometheus.MustRegister(promRetries)
+	prometheus.MustRegister(promCredentialReloads)
+	prometheus.MustRegister(promProviderLookups)
+	prometheus.MustRegister(promFilteredMembers)
 
 	http.Handle("/metrics", promhttp.Handler())
 
@@ -121,13 +502,14 @@ func serve(address string) {
 	log.Fatal(http.ListenAndServe(address, nil))
 }
 
-// Handles SIGTERM and exits
-func handleSigterm(stopChan chan struct{}) {
+// Handles SIGTERM and cancels the context to stop the synchronizer and release the leader lease
+func handleSigterm(cancel context.CancelFunc) {
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGTERM)
 	<-signals
 	log.Info("received SIGTERM. Terminating...")
-	close(stopChan)
+	ready.Store(false)
+	cancel()
 }
 
 // Gets kubernetes config and client
@@ -145,6 +527,16 @@ func getKubeClient() (*kubernetes.Clientset, error) {
 	return clientSet, err
 }
 
+// Gets a client for custom resources, such as GroupBindings
+func getDynamicClient() (dynamic.Interface, error) {
+	kubeconfig, err := getK8sConfig()
+	if err != nil {
+		log.Fatal("unable to initialize kubernetes config")
+	}
+
+	return dynamic.NewForConfig(kubeconfig)
+}
+
 func getK8sConfig() (*rest.Config, error) {
 	if kubeconfig == "" {
 		log.Infof("using in-cluster configuration")
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+// Exit codes of the plan command
+const (
+	PlanNoChanges = 0
+	PlanFailed    = 1
+	PlanChanges   = 2
+)
+
+type RoleBindingChange struct {
+	Namespace       string   `json:"namespace"`
+	Name            string   `json:"name"`
+	Action          string   `json:"action"`
+	Role            string   `json:"role"`
+	PreviousRole    string   `json:"previousRole,omitempty"`
+	AddedSubjects   []string `json:"addedSubjects,omitempty"`
+	RemovedSubjects []string `json:"removedSubjects,omitempty"`
+}
+
+type Plan struct {
+	Changes         []RoleBindingChange `json:"changes"`
+	StaleNamespaces []string            `json:"staleNamespaces,omitempty"`
+}
+
+// Runs the plan command, writes the plan to w in the given output format and returns the exit code
+func runPlan(ctx context.Context, s *Synchronizer, output string, w io.Writer) int {
+	if output != "text" && output != "json" {
+		log.Errorf("unknown output format %q, must be text or json", output)
+		return PlanFailed
+	}
+
+	plan, err := s.plan(ctx)
+	if err != nil {
+		log.Error(err)
+		return PlanFailed
+	}
+
+	if output == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(plan)
+	} else {
+		err = plan.writeText(w)
+	}
+
+	if err != nil {
+		log.Errorf("unable to write plan: %s", err)
+		return PlanFailed
+	}
+
+	// The plan is incomplete when group lookups failed
+	if len(plan.StaleNamespaces) > 0 {
+		log.Errorf("unable to get group members for namespaces: %v", plan.StaleNamespaces)
+		return PlanFailed
+	}
+
+	if len(plan.Changes) > 0 {
+		return PlanChanges
+	}
+
+	return PlanNoChanges
+}
+
+// Compares the desired role bindings of all namespaces with the managed role bindings in the cluster once
+func (s *Synchronizer) plan(ctx context.Context) (*Plan, error) {
+	namespaces, err := s.getTargetNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := s.getCurrentManagedRoleBindings(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	desired, stale := s.getDesiredRoleBindings(ctx, namespaces)
+
+	// Role bindings in stale namespaces are kept as they are
+	current = withoutNamespaces(current, stale)
+
+	return &Plan{
+		Changes:         roleBindingChanges(planRoleBindings(desired, current), current),
+		StaleNamespaces: stale,
+	}, nil
+}
+
+func roleBindingChanges(plan RoleBindingPlan, current []rbacv1.RoleBinding) (changes []RoleBindingChange) {
+	for _, roleBinding := range plan.Added {
+		changes = append(changes, RoleBindingChange{
+			Namespace:     roleBinding.Namespace,
+			Name:          roleBinding.Name,
+			Action:        "create",
+			Role:          roleBinding.RoleRef.Name,
+			AddedSubjects: subjectNames(roleBinding.Subjects),
+		})
+	}
+
+	for _, roleBinding := range plan.Orphans {
+		changes = append(changes, RoleBindingChange{
+			Namespace:       roleBinding.Namespace,
+			Name:            roleBinding.Name,
+			Action:          "delete",
+			Role:            roleBinding.RoleRef.Name,
+			RemovedSubjects: subjectNames(roleBinding.Subjects),
+		})
+	}
+
+	for _, roleBinding := range plan.Updated {
+		match, err := getMatchingRoleBinding(roleBinding, current)
+		if err != nil {
+			continue
+		}
+
+		change := RoleBindingChange{
+			Namespace:       roleBinding.Namespace,
+			Name:            roleBinding.Name,
+			Action:          "update",
+			Role:            roleBinding.RoleRef.Name,
+			AddedSubjects:   missingSubjects(match.Subjects, roleBinding.Subjects),
+			RemovedSubjects: missingSubjects(roleBinding.Subjects, match.Subjects),
+		}
+		if match.RoleRef.Name != roleBinding.RoleRef.Name {
+			change.PreviousRole = match.RoleRef.Name
+		}
+		changes = append(changes, change)
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Namespace != changes[j].Namespace {
+			return changes[i].Namespace < changes[j].Namespace
+		}
+		return changes[i].Name < changes[j].Name
+	})
+
+	return
+}
+
+func (p Plan) writeText(w io.Writer) error {
+	if len(p.Changes) == 0 {
+		_, err := fmt.Fprintln(w, "No changes, role bindings are up to date.")
+		return err
+	}
+
+	symbols := map[string]string{"create": "+", "delete": "-", "update": "~"}
+	count := make(map[string]int)
+	namespace := ""
+
+	for _, change := range p.Changes {
+		if change.Namespace != namespace {
+			namespace = change.Namespace
+			fmt.Fprintf(w, "namespace %s:\n", namespace)
+		}
+
+		role := change.Role
+		if change.PreviousRole != "" {
+			role = fmt.Sprintf("%s -> %s", change.PreviousRole, change.Role)
+		}
+		fmt.Fprintf(w, "  %s %s (role %s)\n", symbols[change.Action], change.Name, role)
+
+		for _, subject := range change.AddedSubjects {
+			fmt.Fprintf(w, "      + %s\n", subject)
+		}
+		for _, subject := range change.RemovedSubjects {
+			fmt.Fprintf(w, "      - %s\n", subject)
+		}
+
+		count[change.Action]++
+	}
+
+	_, err := fmt.Fprintf(w, "\n%d to create, %d to update, %d to delete\n", count["create"], count["update"], count["delete"])
+	return err
+}
+
+func subjectNames(subjects []rbacv1.Subject) (names []string) {
+	for _, subject := range subjects {
+		names = append(names, subject.Name)
+	}
+	return
+}
+
+// Returns the names of the subjects in s2 that are not in s1
+func missingSubjects(s1, s2 []rbacv1.Subject) (missing []string) {
+	existing := make(map[rbacv1.Subject]bool)
+	for _, subject := range s1 {
+		existing[subjectKey(subject)] = true
+	}
+
+	for _, subject := range s2 {
+		if !existing[subjectKey(subject)] {
+			missing = append(missing, subject.Name)
+		}
+	}
+	return
+}
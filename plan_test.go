@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPlan(t *testing.T) {
+	ctx := context.Background()
+	team := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team",
+		Annotations: map[string]string{GroupNameAnnotation: "team@acme.no", RolesAnnotation: "admin,view"},
+	}}
+	current := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com", "d@e.fi", "x@y.z"}))
+	orphan := roleBinding("prefix", "gone", "admin", subjects([]string{"a@b.com"}))
+
+	t.Run("prints changes as text and exits with drift", func(t *testing.T) {
+		synchronizer := NewSynchronizer(fake.NewSimpleClientset(team, &current, &orphan), MockAdminService{}, time.Hour, "", "", "admin", "prefix")
+
+		var out bytes.Buffer
+		assert.Equal(t, PlanChanges, runPlan(ctx, synchronizer, "text", &out))
+		assert.Equal(t, `namespace gone:
+  - prefix-admin (role admin)
+      - a@b.com
+namespace team:
+  ~ prefix-admin (role admin)
+      + h@i.jp
+      - x@y.z
+  + prefix-view (role view)
+      + a@b.com
+      + d@e.fi
+      + h@i.jp
+
+1 to create, 1 to update, 1 to delete
+`, out.String())
+	})
+
+	t.Run("prints changes as json", func(t *testing.T) {
+		synchronizer := NewSynchronizer(fake.NewSimpleClientset(team, &current), MockAdminService{}, time.Hour, "", "", "admin", "prefix")
+
+		var out bytes.Buffer
+		assert.Equal(t, PlanChanges, runPlan(ctx, synchronizer, "json", &out))
+
+		var plan Plan
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &plan))
+		assert.Equal(t, []RoleBindingChange{{
+			Namespace:       "team",
+			Name:            "prefix-admin",
+			Action:          "update",
+			Role:            "admin",
+			AddedSubjects:   []string{"h@i.jp"},
+			RemovedSubjects: []string{"x@y.z"},
+		}, {
+			Namespace:     "team",
+			Name:          "prefix-view",
+			Action:        "create",
+			Role:          "view",
+			AddedSubjects: []string{"a@b.com", "d@e.fi", "h@i.jp"},
+		}}, plan.Changes)
+	})
+
+	t.Run("exits without drift when up to date", func(t *testing.T) {
+		upToDate := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com", "d@e.fi", "h@i.jp"}))
+		synchronizer := NewSynchronizer(fake.NewSimpleClientset(team, &upToDate), MockAdminService{}, time.Hour, "", "", "admin", "prefix")
+		team := team.DeepCopy()
+		team.Annotations[RolesAnnotation] = "admin"
+		_, err := synchronizer.Clientset.CoreV1().Namespaces().Update(ctx, team, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+
+		var out bytes.Buffer
+		assert.Equal(t, PlanNoChanges, runPlan(ctx, synchronizer, "text", &out))
+		assert.Equal(t, "No changes, role bindings are up to date.\n", out.String())
+	})
+
+	t.Run("keeps role bindings in stale namespaces and fails", func(t *testing.T) {
+		broken := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "broken",
+			Annotations: map[string]string{GroupNameAnnotation: "nonexistent"},
+		}}
+		existing := roleBinding("prefix", "broken", "admin", subjects([]string{"a@b.com"}))
+		synchronizer := NewSynchronizer(fake.NewSimpleClientset(broken, &existing), MockAdminService{}, time.Hour, "", "", "admin", "prefix")
+
+		var out bytes.Buffer
+		assert.Equal(t, PlanFailed, runPlan(ctx, synchronizer, "json", &out))
+
+		var plan Plan
+		assert.NoError(t, json.Unmarshal(out.Bytes(), &plan))
+		assert.Empty(t, plan.Changes)
+		assert.Equal(t, []string{"broken"}, plan.StaleNamespaces)
+	})
+
+	t.Run("fails on unknown output format", func(t *testing.T) {
+		synchronizer := NewSynchronizer(fake.NewSimpleClientset(), MockAdminService{}, time.Hour, "", "", "admin", "prefix")
+		assert.Equal(t, PlanFailed, runPlan(ctx, synchronizer, "yaml", &bytes.Buffer{}))
+	})
+}
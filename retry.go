@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries: 5,
+	BaseDelay:  time.Second,
+	MaxDelay:   30 * time.Second,
+}
+
+var DefaultCallConfig = CallConfig{Retry: DefaultRetryConfig}
+
+// How the IAM providers call their APIs, embedded in each of them
+type CallConfig struct {
+	// Timeout of each call, e.g. of one page of members, 0 for none
+	Timeout time.Duration
+	// Retries of calls that were rate limited or failed with a server error
+	Retry RetryConfig
+}
+
+// Calls f with a context that times out after Timeout, retrying it as Retry says
+func (c CallConfig) call(ctx context.Context, operation string, f func(ctx context.Context) error) error {
+	return c.Retry.do(ctx, operation, func() error {
+		callCtx, cancel := withTimeout(ctx, c.Timeout)
+		defer cancel()
+
+		return f(callCtx)
+	})
+}
+
+// Error response of an HTTP API that is called without a generated client
+type HTTPError struct {
+	StatusCode int
+	Header     http.Header
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Returns the status code and headers of a failed API call
+func errorResponse(err error) (int, http.Header, bool) {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Code, apiErr.Header, true
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode, httpErr.Header, true
+	}
+
+	return 0, nil, false
+}
+
+// Retries with exponential backoff and jitter, starting at BaseDelay and doubling up to MaxDelay
+type RetryConfig struct {
+	MaxRetries int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+}
+
+// Calls f until it succeeds, fails with an error that is not worth retrying, or MaxRetries is reached
+func (r RetryConfig) do(ctx context.Context, operation string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= r.MaxRetries || !isRetryable(ctx, err) {
+			return err
+		}
+
+		delay := r.delay(attempt, err)
+		promErrors.WithLabelValues(operation).Inc()
+		promRetries.WithLabelValues(operation).Inc()
+		log.Warnf("%s failed, retrying in %s (%d/%d): %s", operation, delay, attempt+1, r.MaxRetries, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// Rate limiting, server errors, network errors and timeouts of a single call are retried, unless the caller has given up
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if code, header, ok := errorResponse(err); ok {
+		return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError || isRateLimited(code, header)
+	}
+
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		return ldap.IsErrorAnyOf(err, ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable)
+	}
+
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// Returns the backoff for the given attempt with full jitter, or the delay asked for by the API if longer. The delay
+// never exceeds MaxDelay, so that a rate limit reset far ahead fails the lookup rather than holding up a worker.
+func (r RetryConfig) delay(attempt int, err error) time.Duration {
+	backoff := r.BaseDelay << attempt
+	if backoff > r.MaxDelay || backoff <= 0 {
+		backoff = r.MaxDelay
+	}
+	if backoff > 0 {
+		backoff = time.Duration(rand.Int63n(int64(backoff))) + 1
+	}
+
+	if retryAfter := retryAfter(err); retryAfter > backoff {
+		if retryAfter > r.MaxDelay {
+			return r.MaxDelay
+		}
+		return retryAfter
+	}
+	return backoff
+}
+
+// Some APIs, like GitHub, answer 403 Forbidden when rate limited, with headers telling when to try again
+func isRateLimited(code int, header http.Header) bool {
+	return code == http.StatusForbidden && (header.Get("Retry-After") != "" || header.Get("X-RateLimit-Remaining") == "0")
+}
+
+// Returns the delay asked for in Retry-After, or until X-RateLimit-Reset when the rate limit is exhausted
+func retryAfter(err error) time.Duration {
+	_, header, ok := errorResponse(err)
+	if !ok || header == nil {
+		return 0
+	}
+
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Until(time.Unix(reset, 0))
+		}
+	}
+	return 0
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -5,8 +5,62 @@ import (
 	"github.com/prometheus/common/log"
 	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	rbacv1ac "k8s.io/client-go/applyconfigurations/rbac/v1"
+	"strings"
 )
 
+// The changes needed to make the current role bindings match the desired ones
+type RoleBindingPlan struct {
+	Orphans []rbacv1.RoleBinding
+	Added   []rbacv1.RoleBinding
+	Updated []rbacv1.RoleBinding
+}
+
+func planRoleBindings(desired, current []rbacv1.RoleBinding) (plan RoleBindingPlan) {
+	// Managed bindings that exist in cluster, but is not part of the configuration
+	plan.Orphans = diff(desired, current)
+
+	// Remove orphans from list of current role bindings
+	current = diff(plan.Orphans, current)
+
+	// New role bindings to create
+	plan.Added = diff(current, desired)
+
+	// Role bindings to be created are not compared with the current ones
+	current = append(current, plan.Added...)
+
+	plan.Updated = roleBindingsToUpdate(desired, current)
+
+	return
+}
+
+func (p RoleBindingPlan) isEmpty() bool {
+	return len(p.Orphans) == 0 && len(p.Added) == 0 && len(p.Updated) == 0
+}
+
+// Returns the role bindings that are not in any of the given namespaces
+func withoutNamespaces(roleBindings []rbacv1.RoleBinding, namespaces []string) (filtered []rbacv1.RoleBinding) {
+	excluded := make(map[string]bool)
+	for _, namespace := range namespaces {
+		excluded[namespace] = true
+	}
+
+	for _, roleBinding := range roleBindings {
+		if !excluded[roleBinding.Namespace] {
+			filtered = append(filtered, roleBinding)
+		}
+	}
+
+	return
+}
+
+func names(roleBindings []rbacv1.RoleBinding) (names []string) {
+	for _, roleBinding := range roleBindings {
+		names = append(names, roleBinding.Name)
+	}
+	return
+}
+
 func roleBindingsToUpdate(desired []rbacv1.RoleBinding, current []rbacv1.RoleBinding) (updated []rbacv1.RoleBinding) {
 	for _, rolebinding := range desired {
 		match, err := getMatchingRoleBinding(rolebinding, current)
@@ -20,6 +74,12 @@ func roleBindingsToUpdate(desired []rbacv1.RoleBinding, current []rbacv1.RoleBin
 			continue
 		}
 
+		// Subject names are compared ignoring case, so a change of templates is told by the templates themselves
+		if rolebinding.Annotations[SubjectTemplatesAnnotation] != match.Annotations[SubjectTemplatesAnnotation] {
+			updated = append(updated, rolebinding)
+			continue
+		}
+
 		if hasDifferentSubjects(rolebinding.Subjects, match.Subjects) {
 			updated = append(updated, rolebinding)
 			continue
@@ -40,7 +100,7 @@ func getMatchingRoleBinding(roleBinding rbacv1.RoleBinding, roleBindings []rbacv
 }
 
 // hasDifferentSubjects checks compares two slices of Subjects and returns true
-// if they contain different members
+// if they contain different members. Names are compared ignoring case, as e-mail addresses are.
 func hasDifferentSubjects(s1 []rbacv1.Subject, s2 []rbacv1.Subject) bool {
 	if len(s1) != len(s2) {
 		return true
@@ -49,7 +109,7 @@ func hasDifferentSubjects(s1 []rbacv1.Subject, s2 []rbacv1.Subject) bool {
 	for _, subject1 := range s1 {
 		match := false
 		for _, subject2 := range s2 {
-			if subject1.Name == subject2.Name {
+			if subjectKey(subject1) == subjectKey(subject2) {
 				match = true
 			}
 		}
@@ -79,7 +139,7 @@ func diff(base, roleBindings []rbacv1.RoleBinding) (diff []rbacv1.RoleBinding) {
 	return
 }
 
-func roleBinding(rolebindingPrefix string, namespace string, role string, members []string) rbacv1.RoleBinding {
+func roleBinding(rolebindingPrefix string, namespace string, role string, subjects []rbacv1.Subject) rbacv1.RoleBinding {
 	return rbacv1.RoleBinding{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      fmt.Sprintf("%s-%s", rolebindingPrefix, role),
@@ -92,19 +152,46 @@ func roleBinding(rolebindingPrefix string, namespace string, role string, member
 			APIGroup: RBACAPIGroup,
 			Name:     role,
 		},
-		Subjects: subjects(members),
+		Subjects: subjects,
 	}
 }
 
-func subjects(members []string) (subjects []rbacv1.Subject) {
-	for _, member := range members {
+// Identifies a subject by kind and normalised name
+func subjectKey(subject rbacv1.Subject) rbacv1.Subject {
+	return rbacv1.Subject{Kind: subject.Kind, Name: strings.ToLower(subject.Name)}
+}
 
-		subjects = append(subjects, rbacv1.Subject{
-			Kind:     "User",
-			APIGroup: RBACAPIGroup,
-			Name:     member,
-		})
+// Returns a role binding that records the subject templates, unless the subject names are e-mail addresses as they are
+func templatedRoleBinding(rolebindingPrefix string, namespace string, role string, subjects []rbacv1.Subject, templates SubjectTemplates) rbacv1.RoleBinding {
+	binding := roleBinding(rolebindingPrefix, namespace, role, subjects)
+	if !templates.isDefault() {
+		binding.Annotations = map[string]string{SubjectTemplatesAnnotation: templates.String()}
 	}
+	return binding
+}
 
-	return
+func roleBindingApplyConfiguration(roleBinding rbacv1.RoleBinding) *rbacv1ac.RoleBindingApplyConfiguration {
+	var subjects []*rbacv1ac.SubjectApplyConfiguration
+	for _, subject := range roleBinding.Subjects {
+		applyConfiguration := rbacv1ac.Subject().WithKind(subject.Kind).WithName(subject.Name)
+		if subject.APIGroup != "" {
+			applyConfiguration.WithAPIGroup(subject.APIGroup)
+		}
+		if subject.Namespace != "" {
+			applyConfiguration.WithNamespace(subject.Namespace)
+		}
+		subjects = append(subjects, applyConfiguration)
+	}
+
+	binding := rbacv1ac.RoleBinding(roleBinding.Name, roleBinding.Namespace).WithLabels(roleBinding.Labels)
+	if len(roleBinding.Annotations) > 0 {
+		binding.WithAnnotations(roleBinding.Annotations)
+	}
+
+	return binding.
+		WithRoleRef(rbacv1ac.RoleRef().
+			WithKind(roleBinding.RoleRef.Kind).
+			WithAPIGroup(roleBinding.RoleRef.APIGroup).
+			WithName(roleBinding.RoleRef.Name)).
+		WithSubjects(subjects...)
 }
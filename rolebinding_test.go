@@ -17,16 +17,16 @@ func TestRolebindings(t *testing.T) {
 	})
 
 	t.Run("finds no role bindings when subjects are just out of order", func(t *testing.T) {
-		r1 := roleBinding("a", "ns1", "admin", []string{"x", "y", "z"})
-		r2 := roleBinding("a", "ns1", "admin", []string{"z", "x", "y"})
+		r1 := roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"}))
+		r2 := roleBinding("a", "ns1", "admin", subjects([]string{"z", "x", "y"}))
 
 		toUpdate := roleBindingsToUpdate([]rbacv1.RoleBinding{r1}, []rbacv1.RoleBinding{r2})
 		assert.Equal(t, len(toUpdate), 0)
 	})
 
 	t.Run("finds updated role bindings when subject has been added", func(t *testing.T) {
-		r1 := roleBinding("a", "ns1", "admin", []string{"x", "y", "z"})
-		r2 := roleBinding("a", "ns1", "admin", []string{"x", "y"})
+		r1 := roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"}))
+		r2 := roleBinding("a", "ns1", "admin", subjects([]string{"x", "y"}))
 
 		toUpdate := roleBindingsToUpdate([]rbacv1.RoleBinding{r1}, []rbacv1.RoleBinding{r2})
 		assert.Equal(t, len(toUpdate), 1)
@@ -34,8 +34,8 @@ func TestRolebindings(t *testing.T) {
 	})
 
 	t.Run("finds updated role bindings when subject has been removed", func(t *testing.T) {
-		r1 := roleBinding("a", "ns1", "admin", []string{"x", "y"})
-		r2 := roleBinding("a", "ns1", "admin", []string{"x", "y", "z"})
+		r1 := roleBinding("a", "ns1", "admin", subjects([]string{"x", "y"}))
+		r2 := roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"}))
 
 		toUpdate := roleBindingsToUpdate([]rbacv1.RoleBinding{r1}, []rbacv1.RoleBinding{r2})
 		assert.Equal(t, len(toUpdate), 1)
@@ -43,14 +43,29 @@ func TestRolebindings(t *testing.T) {
 	})
 
 	t.Run("finds updated role bindings when subject has changed", func(t *testing.T) {
-		r1 := roleBinding("a", "ns1", "admin", []string{"x", "y", "z"})
-		r2 := roleBinding("a", "ns1", "admin", []string{"a", "x", "y"})
+		r1 := roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"}))
+		r2 := roleBinding("a", "ns1", "admin", subjects([]string{"a", "x", "y"}))
 
 		toUpdate := roleBindingsToUpdate([]rbacv1.RoleBinding{r1}, []rbacv1.RoleBinding{r2})
 		assert.Equal(t, len(toUpdate), 1)
 		assert.Equal(t, toUpdate[0], r1)
 	})
 
+	t.Run("plans orphans, additions and updates", func(t *testing.T) {
+		orphan := roleBinding("a", "ns1", "admin", nil)
+		unchanged := roleBinding("b", "ns1", "admin", subjects([]string{"x"}))
+		changed := roleBinding("b", "ns1", "view", subjects([]string{"x"}))
+		added := roleBinding("b", "ns1", "edit", subjects([]string{"x"}))
+
+		plan := planRoleBindings(
+			[]rbacv1.RoleBinding{unchanged, roleBinding("b", "ns1", "view", subjects([]string{"x", "y"})), added},
+			[]rbacv1.RoleBinding{orphan, unchanged, changed})
+
+		assert.Equal(t, []string{"a-admin"}, names(plan.Orphans))
+		assert.Equal(t, []string{"b-edit"}, names(plan.Added))
+		assert.Equal(t, []string{"b-view"}, names(plan.Updated))
+	})
+
 	t.Run("errors when not finding any matching role bindings", func(t *testing.T) {
 		roleBindings := []rbacv1.RoleBinding{roleBinding("a", "ns2", "", nil)}
 		_, err := getMatchingRoleBinding(roleBinding("a", "ns1", "", nil), roleBindings)
@@ -58,18 +73,45 @@ func TestRolebindings(t *testing.T) {
 	})
 
 	t.Run("test subject diff evaluator", func(t *testing.T) {
-		s1 := []rbacv1.Subject{{"User", RBACAPIGroup, "testuser@test.domain", "ns1"}}
-		s2 := []rbacv1.Subject{{"User", RBACAPIGroup, "testuser@test.domain", "ns1"},
-			{"User", RBACAPIGroup, "testuser2@test.domain", "ns2"}}
-		s3 := []rbacv1.Subject{{"User", RBACAPIGroup, "testuser@test.domain", "ns1"},
-			{"User", RBACAPIGroup, "testuser2@test.domain", "ns2"}}
-		s4 := []rbacv1.Subject{{"User", RBACAPIGroup, "testuser3@test.domain", "ns1"},
-			{"User", RBACAPIGroup, "testuser4@test.domain", "ns2"}}
+		s1 := []rbacv1.Subject{{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser@test.domain", Namespace: "ns1"}}
+		s2 := []rbacv1.Subject{{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser@test.domain", Namespace: "ns1"},
+			{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser2@test.domain", Namespace: "ns2"}}
+		s3 := []rbacv1.Subject{{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser@test.domain", Namespace: "ns1"},
+			{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser2@test.domain", Namespace: "ns2"}}
+		s4 := []rbacv1.Subject{{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser3@test.domain", Namespace: "ns1"},
+			{Kind: "User", APIGroup: RBACAPIGroup, Name: "testuser4@test.domain", Namespace: "ns2"}}
 		// should return true as slices have different length
 		assert.True(t, hasDifferentSubjects(s1, s2))
 		// should return false as match is found
 		assert.False(t, hasDifferentSubjects(s2, s3))
 		// should return true as no match is found
 		assert.True(t, hasDifferentSubjects(s3, s4))
+		// should return true as a group is not the same as a user with the same name
+		assert.True(t, hasDifferentSubjects(s1, []rbacv1.Subject{groupSubject("testuser@test.domain")}))
+		// should return false as names differing by case only are the same
+		assert.False(t, hasDifferentSubjects(s1, subjects([]string{"TestUser@test.domain"})))
+	})
+
+	t.Run("updates role bindings when subject templates change", func(t *testing.T) {
+		templates, _ := NewSubjectTemplates("oidc:{{ .Email }}", "")
+		current := roleBinding("a", "ns1", "admin", subjects([]string{"oidc:Alice@example.com"}))
+		desired := templatedRoleBinding("a", "ns1", "admin", subjects([]string{"oidc:alice@example.com"}), templates)
+
+		assert.Empty(t, roleBindingsToUpdate([]rbacv1.RoleBinding{current}, []rbacv1.RoleBinding{current}))
+		assert.Equal(t, []rbacv1.RoleBinding{desired}, roleBindingsToUpdate([]rbacv1.RoleBinding{desired}, []rbacv1.RoleBinding{current}))
+		assert.Empty(t, roleBindingsToUpdate([]rbacv1.RoleBinding{desired}, []rbacv1.RoleBinding{desired}))
 	})
 }
+
+// User subjects with the given names
+func subjects(names []string) (subjects []rbacv1.Subject) {
+	for _, name := range names {
+		subjects = append(subjects, rbacv1.Subject{
+			Kind:     "User",
+			APIGroup: RBACAPIGroup,
+			Name:     name,
+		})
+	}
+
+	return
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	MemberRolesAnnotation = AnnotationNS + "/member-roles"
+	// Maps members whose role is not mapped otherwise, including members of providers that do not tell roles
+	AnyMemberRole = "*"
+)
+
+// Maps member roles in a group (OWNER, MANAGER, MEMBER or *) to the ClusterRoles their members are bound to
+type RoleMapping map[string][]string
+
+// Parses a mapping given as comma-separated <member role>=<cluster role> pairs, e.g. OWNER=admin,MEMBER=view.
+// A member role may be given more than once to bind its members to several ClusterRoles.
+func ParseRoleMapping(mapping string) (RoleMapping, error) {
+	roles := RoleMapping{}
+	for _, pair := range splitList(mapping) {
+		memberRole, clusterRole, ok := strings.Cut(pair, "=")
+		memberRole, clusterRole = strings.ToUpper(strings.TrimSpace(memberRole)), strings.TrimSpace(clusterRole)
+		if !ok || clusterRole == "" {
+			return nil, fmt.Errorf("member role mapping %q is not of the form <member role>=<cluster role>", pair)
+		}
+
+		switch memberRole {
+		case MemberRoleOwner, MemberRoleManager, MemberRoleMember, AnyMemberRole:
+			if !contains(roles[memberRole], clusterRole) {
+				roles[memberRole] = append(roles[memberRole], clusterRole)
+			}
+		default:
+			return nil, fmt.Errorf("unknown member role %s, must be %s, %s, %s or %s", memberRole, MemberRoleOwner, MemberRoleManager, MemberRoleMember, AnyMemberRole)
+		}
+	}
+
+	return roles, nil
+}
+
+func (m RoleMapping) String() string {
+	var pairs []string
+	for _, memberRole := range []string{MemberRoleOwner, MemberRoleManager, MemberRoleMember, AnyMemberRole} {
+		for _, clusterRole := range m[memberRole] {
+			pairs = append(pairs, memberRole+"="+clusterRole)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the ClusterRoles that members are mapped to, sorted by name
+func (m RoleMapping) clusterRoles() (clusterRoles []string) {
+	seen := map[string]bool{}
+	for _, roles := range m {
+		for _, role := range roles {
+			if !seen[role] {
+				seen[role] = true
+				clusterRoles = append(clusterRoles, role)
+			}
+		}
+	}
+	sort.Strings(clusterRoles)
+	return
+}
+
+// Returns the members bound to each ClusterRole. Members whose role is not mapped, and not covered by *, are not
+// bound to anything.
+func (m RoleMapping) bind(members []Member) map[string][]Member {
+	bound := map[string][]Member{}
+	for _, member := range members {
+		clusterRoles, ok := m[member.Role]
+		if !ok {
+			clusterRoles = m[AnyMemberRole]
+		}
+
+		for _, clusterRole := range clusterRoles {
+			bound[clusterRole] = append(bound[clusterRole], member)
+		}
+	}
+	return bound
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoleMapping(t *testing.T) {
+	t.Run("pairs of member role and cluster role", func(t *testing.T) {
+		mapping, err := ParseRoleMapping("owner=admin, MANAGER=edit,OWNER=edit,*=view,OWNER=admin")
+		assert.NoError(t, err)
+		assert.Equal(t, RoleMapping{
+			MemberRoleOwner:   {"admin", "edit"},
+			MemberRoleManager: {"edit"},
+			AnyMemberRole:     {"view"},
+		}, mapping)
+		assert.Equal(t, "OWNER=admin,OWNER=edit,MANAGER=edit,*=view", mapping.String())
+		assert.Equal(t, []string{"admin", "edit", "view"}, mapping.clusterRoles())
+	})
+
+	t.Run("empty mapping", func(t *testing.T) {
+		mapping, err := ParseRoleMapping("")
+		assert.NoError(t, err)
+		assert.Empty(t, mapping)
+	})
+
+	t.Run("invalid mappings", func(t *testing.T) {
+		for _, mapping := range []string{"admin", "OWNER=", "ADMIN=admin", "=view"} {
+			_, err := ParseRoleMapping(mapping)
+			assert.Error(t, err, mapping)
+		}
+	})
+}
+
+func TestRoleMappingBind(t *testing.T) {
+	members := []Member{
+		{Email: "owner@example.com", Role: MemberRoleOwner},
+		{Email: "manager@example.com", Role: MemberRoleManager},
+		{Email: "member@example.com", Role: MemberRoleMember},
+		{Email: "unknown@example.com"},
+	}
+
+	t.Run("unmapped roles fall back to *", func(t *testing.T) {
+		mapping, _ := ParseRoleMapping("OWNER=admin,OWNER=view,*=view")
+		bound := mapping.bind(members)
+		assert.Len(t, bound, 2)
+		assert.Equal(t, []string{"owner@example.com"}, emails(bound["admin"]))
+		assert.Equal(t, []string{"owner@example.com", "manager@example.com", "member@example.com", "unknown@example.com"}, emails(bound["view"]))
+	})
+
+	t.Run("unmapped roles are not bound without *", func(t *testing.T) {
+		mapping, _ := ParseRoleMapping("OWNER=admin,MANAGER=admin,MEMBER=view")
+		bound := mapping.bind(members)
+		assert.Len(t, bound, 2)
+		assert.Equal(t, []string{"owner@example.com", "manager@example.com"}, emails(bound["admin"]))
+		assert.Equal(t, []string{"member@example.com"}, emails(bound["view"]))
+	})
+}
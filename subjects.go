@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+const (
+	SubjectModeAnnotation = AnnotationNS + "/subject-mode"
+	// Binds every member of the group, expanding nested groups, as User subjects
+	SubjectModeUser = "user"
+	// Binds the group itself as a single Group subject, without looking up its members
+	SubjectModeGroup = "group"
+	// Binds the direct users of the group as User subjects and nested groups as Group subjects
+	SubjectModeHybrid = "hybrid"
+
+	UserSubjectTemplateAnnotation  = AnnotationNS + "/user-subject-template"
+	GroupSubjectTemplateAnnotation = AnnotationNS + "/group-subject-template"
+	// Set on role bindings whose subject names were rendered by other templates than the default one
+	SubjectTemplatesAnnotation = AnnotationNS + "/subject-templates"
+	DefaultSubjectTemplate     = "{{ .Email }}"
+)
+
+// Go templates of the names of User and Group subjects, rendered with the fields of a Member. A nil template
+// renders the e-mail address as it is.
+type SubjectTemplates struct {
+	User  *template.Template
+	Group *template.Template
+}
+
+// Parses the templates of User and Group subject names, e.g. oidc:{{ .Email | lower }}
+func NewSubjectTemplates(user, group string) (templates SubjectTemplates, err error) {
+	if templates.User, err = parseSubjectTemplate("user", user); err != nil {
+		return
+	}
+	templates.Group, err = parseSubjectTemplate("group", group)
+	return
+}
+
+// Parses subject templates by provider, where the templates without a provider apply to the providers without
+// their own
+func NewSubjectTemplatesByProvider(users, groups map[string]string) (map[string]SubjectTemplates, error) {
+	byProvider := map[string]SubjectTemplates{}
+	for _, provider := range append([]string{""}, Providers...) {
+		user, ok := users[provider]
+		if !ok {
+			user = users[""]
+		}
+		group, ok := groups[provider]
+		if !ok {
+			group = groups[""]
+		}
+
+		templates, err := NewSubjectTemplates(user, group)
+		if err != nil {
+			if provider != "" {
+				err = fmt.Errorf("%s provider: %s", provider, err)
+			}
+			return nil, err
+		}
+		byProvider[provider] = templates
+	}
+
+	return byProvider, nil
+}
+
+func parseSubjectTemplate(name, text string) (*template.Template, error) {
+	if strings.TrimSpace(text) == "" || text == DefaultSubjectTemplate {
+		return nil, nil
+	}
+
+	tmpl, err := template.New(name).Funcs(template.FuncMap{"lower": strings.ToLower, "upper": strings.ToUpper}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s subject template: %s", name, err)
+	}
+
+	// Render a member up front, so that templates referring to unknown fields are rejected here
+	if _, err := render(tmpl, Member{Email: "test@example.com"}); err != nil {
+		return nil, fmt.Errorf("invalid %s subject template: %s", name, err)
+	}
+
+	return tmpl, nil
+}
+
+func (t SubjectTemplates) String() string {
+	return fmt.Sprintf("user: %s, group: %s", templateText(t.User), templateText(t.Group))
+}
+
+func (t SubjectTemplates) isDefault() bool {
+	return t.User == nil && t.Group == nil
+}
+
+// Returns a User subject for each member, except for groups that are kept as Group subjects
+func (t SubjectTemplates) subjects(members []Member) (subjects []rbacv1.Subject, err error) {
+	for _, member := range members {
+		tmpl := t.User
+		if member.Type == MemberTypeGroup {
+			tmpl = t.Group
+		}
+
+		name, err := render(tmpl, member)
+		if err != nil {
+			return nil, fmt.Errorf("unable to render subject name of %s: %s", member.Email, err)
+		}
+
+		if member.Type == MemberTypeGroup {
+			subjects = append(subjects, groupSubject(name))
+			continue
+		}
+
+		subjects = append(subjects, rbacv1.Subject{
+			Kind:     "User",
+			APIGroup: RBACAPIGroup,
+			Name:     name,
+		})
+	}
+
+	return
+}
+
+func render(tmpl *template.Template, member Member) (string, error) {
+	if tmpl == nil {
+		return member.Email, nil
+	}
+
+	var name bytes.Buffer
+	if err := tmpl.Execute(&name, member); err != nil {
+		return "", err
+	}
+	if name.Len() == 0 {
+		return "", fmt.Errorf("empty subject name")
+	}
+	return name.String(), nil
+}
+
+// Subject templates given on the command line as <template>, or <provider>=<template> for a single provider
+type subjectTemplateFlag map[string]string
+
+func (f subjectTemplateFlag) String() string {
+	var values []string
+	for _, provider := range append([]string{""}, Providers...) {
+		if text, ok := f[provider]; ok && provider == "" {
+			values = append(values, text)
+		} else if ok {
+			values = append(values, provider+"="+text)
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+func (f subjectTemplateFlag) Set(value string) error {
+	if provider, text, ok := strings.Cut(value, "="); ok && isProvider(provider) {
+		f[provider] = text
+		return nil
+	}
+
+	f[""] = value
+	return nil
+}
+
+func templateText(tmpl *template.Template) string {
+	if tmpl == nil {
+		return DefaultSubjectTemplate
+	}
+	return tmpl.Root.String()
+}
+
+func isSubjectMode(mode string) bool {
+	switch mode {
+	case SubjectModeUser, SubjectModeGroup, SubjectModeHybrid:
+		return true
+	}
+	return false
+}
+
+func groupSubject(group string) rbacv1.Subject {
+	return rbacv1.Subject{
+		Kind:     "Group",
+		APIGroup: RBACAPIGroup,
+		Name:     group,
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	rbacv1 "k8s.io/api/rbac/v1"
+)
+
+func TestSubjectTemplates(t *testing.T) {
+	members := []Member{
+		{Email: "Alice@Example.com", Type: MemberTypeUser, Role: MemberRoleOwner},
+		{Email: "Platform@Example.com", Type: MemberTypeGroup},
+	}
+
+	t.Run("default templates keep names as they are", func(t *testing.T) {
+		templates, err := NewSubjectTemplates("", DefaultSubjectTemplate)
+		assert.NoError(t, err)
+		assert.True(t, templates.isDefault())
+
+		subjects, err := templates.subjects(members)
+		assert.NoError(t, err)
+		assert.Equal(t, []rbacv1.Subject{
+			{Kind: "User", APIGroup: RBACAPIGroup, Name: "Alice@Example.com"},
+			groupSubject("Platform@Example.com"),
+		}, subjects)
+	})
+
+	t.Run("prefixed and lower case names", func(t *testing.T) {
+		templates, err := NewSubjectTemplates("oidc:{{ .Email | lower }}", "oidc-group:{{ .Email | upper }}")
+		assert.NoError(t, err)
+		assert.False(t, templates.isDefault())
+		assert.Equal(t, "user: oidc:{{.Email | lower}}, group: oidc-group:{{.Email | upper}}", templates.String())
+
+		subjects, err := templates.subjects(members)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"oidc:alice@example.com", "oidc-group:PLATFORM@EXAMPLE.COM"}, subjectNames(subjects))
+	})
+
+	t.Run("invalid templates", func(t *testing.T) {
+		for _, text := range []string{"{{ .Email", "{{ .Login }}", "{{ .Email | title }}", "{{ if false }}{{ end }}"} {
+			_, err := NewSubjectTemplates(text, "")
+			assert.Error(t, err, text)
+		}
+	})
+}
+
+func TestSubjectTemplatesByProvider(t *testing.T) {
+	users, groups := subjectTemplateFlag{}, subjectTemplateFlag{}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(users, "user-subject-template", "")
+	fs.Var(groups, "group-subject-template", "")
+	assert.NoError(t, fs.Parse([]string{
+		"-user-subject-template", "oidc:{{ .Email | lower }}",
+		"-user-subject-template", "azure=aad:{{ .Email }}",
+		"-user-subject-template", "cn={{ .Email }}",
+		"-group-subject-template", "file=static:{{ .Email }}",
+	}))
+	assert.Equal(t, subjectTemplateFlag{"": "cn={{ .Email }}", ProviderAzure: "aad:{{ .Email }}"}, users, "unknown providers are part of the template")
+	assert.Equal(t, "cn={{ .Email }} azure=aad:{{ .Email }}", users.String())
+
+	byProvider, err := NewSubjectTemplatesByProvider(users, groups)
+	assert.NoError(t, err)
+	assert.Equal(t, "user: cn={{.Email}}, group: {{ .Email }}", byProvider[""].String())
+	assert.Equal(t, "user: cn={{.Email}}, group: {{ .Email }}", byProvider[ProviderGoogle].String())
+	assert.Equal(t, "user: aad:{{.Email}}, group: {{ .Email }}", byProvider[ProviderAzure].String())
+	assert.Equal(t, "user: cn={{.Email}}, group: static:{{.Email}}", byProvider[ProviderFile].String())
+
+	_, err = NewSubjectTemplatesByProvider(subjectTemplateFlag{ProviderLDAP: "{{ .Mail }}"}, nil)
+	assert.ErrorContains(t, err, "ldap provider")
+}
@@ -6,9 +6,21 @@ import (
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	rbaclisters "k8s.io/client-go/listers/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -18,7 +30,10 @@ const (
 	GroupNameAnnotation         = AnnotationNS + "/group-name"
 	RolesAnnotation             = AnnotationNS + "/roles"
 	RolebindingPrefixAnnotation = AnnotationNS + "/rolebinding-prefix"
+	DirectMembersOnlyAnnotation = AnnotationNS + "/direct-members-only"
 	RBACAPIGroup                = "rbac.authorization.k8s.io"
+	TemporaryRoleBindingSuffix  = "-rbac-sync-tmp"
+	FieldManager                = "rbac-sync"
 )
 
 type Synchronizer struct {
@@ -29,6 +44,26 @@ type Synchronizer struct {
 	ServiceAccountKeyFile    string
 	DefaultRoles             string
 	DefaultRoleBindingPrefix string
+	DryRun                   bool
+	MemberFilter             MemberFilter
+	DefaultMemberRoles       RoleMapping
+	SubjectMode              string
+	// Templates of subject names by provider, with the templates of providers without their own under ""
+	SubjectTemplates map[string]SubjectTemplates
+	// The provider of groups without a provider prefix
+	DefaultProvider string
+	// Reads GroupBindings and writes their status. GroupBindings are left alone when nil.
+	DynamicClient dynamic.Interface
+	// Bind no members for groups that the provider reports as not found, instead of keeping their role bindings as for
+	// a failed lookup. Off by default, as some providers also answer not found when access is missing.
+	EmptyMissingGroups bool
+	// ClusterRoles that GroupBindings may bind. When empty, only those of DefaultRoles and DefaultMemberRoles.
+	GroupBindingAllowedRoles []string
+
+	queue              workqueue.RateLimitingInterface
+	namespaceLister    corelisters.NamespaceLister
+	roleBindingLister  rbaclisters.RoleBindingLister
+	groupBindingLister cache.GenericLister
 }
 
 func NewSynchronizer(clientSet kubernetes.Interface,
@@ -46,77 +81,370 @@ func NewSynchronizer(clientSet kubernetes.Interface,
 		ServiceAccountKeyFile:    serviceAccountKeyFile,
 		DefaultRoles:             defaultRoleNames,
 		DefaultRoleBindingPrefix: defaultRolebindingName,
+		SubjectMode:              SubjectModeUser,
+		queue:                    workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "namespaces"),
 	}
 }
 
 func (s Synchronizer) String() string {
-	return fmt.Sprintf("update interval: %s, GCP admin user: %s, default roles: %s, default role binding prefix: %s",
-		s.UpdateInterval, s.GCPAdminUser, s.DefaultRoles, s.DefaultRoleBindingPrefix)
+	return fmt.Sprintf("update interval: %s, GCP admin user: %s, default roles: %s, default role binding prefix: %s, dry run: %t, member filter: %s, default member roles: %s, subject mode: %s, group bindings: %t",
+		s.UpdateInterval, s.GCPAdminUser, s.DefaultRoles, s.DefaultRoleBindingPrefix, s.DryRun, s.MemberFilter, s.DefaultMemberRoles, s.SubjectMode, s.DynamicClient != nil)
 }
 
-// Read namespaces and synchronizes the desired state with the actual cluster state in duration intervals
-func (s *Synchronizer) synchronizeRBAC() {
-	ctx := context.Background()
+// Run starts the namespace, role binding and GroupBinding informers and processes the work queue until stopCh is closed.
+// Every namespace is additionally re-queued on UpdateInterval to pick up changes in IAM group membership.
+func (s *Synchronizer) Run(stopCh <-chan struct{}, workers int) {
+	defer utilruntime.HandleCrash()
+	defer s.queue.ShutDown()
+
+	namespaceFactory := informers.NewSharedInformerFactory(s.Clientset, 0)
+	roleBindingFactory := informers.NewSharedInformerFactoryWithOptions(s.Clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = fmt.Sprintf("%s=true", ManagedLabel)
+		}))
+
+	namespaceInformer := namespaceFactory.Core().V1().Namespaces()
+	roleBindingInformer := roleBindingFactory.Rbac().V1().RoleBindings()
+
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.enqueueNamespace,
+		UpdateFunc: func(old, new interface{}) {
+			if hasChangedAnnotations(old.(*corev1.Namespace), new.(*corev1.Namespace)) {
+				s.enqueueNamespace(new)
+			}
+		},
+	})
+
+	roleBindingInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.enqueueRoleBindingNamespace,
+		UpdateFunc: func(_, new interface{}) {
+			s.enqueueRoleBindingNamespace(new)
+		},
+		DeleteFunc: s.enqueueRoleBindingNamespace,
+	})
+
+	s.namespaceLister = namespaceInformer.Lister()
+	s.roleBindingLister = roleBindingInformer.Lister()
+
+	namespaceFactory.Start(stopCh)
+	roleBindingFactory.Start(stopCh)
+
+	synced := []cache.InformerSynced{namespaceInformer.Informer().HasSynced, roleBindingInformer.Informer().HasSynced}
+	if s.DynamicClient != nil {
+		groupBindingFactory := dynamicinformer.NewDynamicSharedInformerFactory(s.DynamicClient, 0)
+		groupBindingInformer := groupBindingFactory.ForResource(GroupBindingResource)
+
+		groupBindingInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: s.enqueueGroupBindingNamespace,
+			UpdateFunc: func(old, new interface{}) {
+				// Status updates leave the generation alone, and would otherwise queue the namespace again
+				if old.(metav1.Object).GetGeneration() != new.(metav1.Object).GetGeneration() {
+					s.enqueueGroupBindingNamespace(new)
+				}
+			},
+			DeleteFunc: s.enqueueGroupBindingNamespace,
+		})
+
+		s.groupBindingLister = groupBindingInformer.Lister()
+		groupBindingFactory.Start(stopCh)
+		synced = append(synced, groupBindingInformer.Informer().HasSynced)
+	}
+
+	log.Info("waiting for informer caches to sync")
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		log.Error("unable to sync informer caches")
+		return
+	}
+
+	// Cancelled when stopping, so that lookups and retries in progress do not hold up the shutdown or the handover
+	// of the leader lease
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait.Until(func() { s.runWorker(ctx) }, time.Second, stopCh)
+		}()
+	}
+
+	go wait.Until(s.resync, s.UpdateInterval, stopCh)
+
+	<-stopCh
+	log.Info("stopping RBAC synchronizer, waiting for workers to finish")
+	cancel()
+	s.queue.ShutDown()
+	wg.Wait()
+}
+
+// Queues every known namespace, so that group membership is refreshed from IAM
+func (s *Synchronizer) resync() {
+	namespaces, err := s.namespaceLister.List(labels.Everything())
+	if err != nil {
+		log.Errorf("unable to list namespaces from cache: %s", err)
+		return
+	}
+
+	log.Debugf("queueing %d namespaces for periodic resync", len(namespaces))
+	for _, namespace := range namespaces {
+		s.queue.Add(namespace.Name)
+	}
+}
+
+func (s *Synchronizer) enqueueNamespace(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	s.queue.Add(key)
+}
+
+func (s *Synchronizer) enqueueRoleBindingNamespace(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	roleBinding, ok := obj.(*v1.RoleBinding)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected object in role binding event: %T", obj))
+		return
+	}
+	s.queue.Add(roleBinding.Namespace)
+}
+
+func (s *Synchronizer) enqueueGroupBindingNamespace(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+
+	groupBinding, ok := obj.(metav1.Object)
+	if !ok {
+		utilruntime.HandleError(fmt.Errorf("unexpected object in groupbinding event: %T", obj))
+		return
+	}
+	s.queue.Add(groupBinding.GetNamespace())
+}
+
+// Processes items until the queue is shut down or ctx is cancelled. Items left in the queue are not drained.
+func (s *Synchronizer) runWorker(ctx context.Context) {
 	for {
-		current, err := s.getCurrentManagedRoleBindings(ctx)
-		if err != nil {
-			continue
+		select {
+		case <-ctx.Done():
+			return
+		default:
 		}
 
-		// Generate desired rolebindings based on namespace annotations
-		desired := s.getDesiredRoleBindings(s.getTargetNamespaces(ctx))
+		if !s.processNextItem(ctx) {
+			return
+		}
+	}
+}
+
+func (s *Synchronizer) processNextItem(ctx context.Context) bool {
+	key, quit := s.queue.Get()
+	if quit {
+		return false
+	}
+	defer s.queue.Done(key)
+
+	err := s.synchronizeNamespace(ctx, key.(string))
+	if err != nil && ctx.Err() != nil {
+		log.Debugf("synchronization of namespace %s stopped: %s", key, err)
+		return false
+	}
+
+	if err != nil {
+		promErrors.WithLabelValues("synchronize-namespace").Inc()
+		log.Errorf("unable to synchronize namespace %s, requeueing: %s", key, err)
+		s.queue.AddRateLimited(key)
+		return true
+	}
 
-		// Managed bindings that exist in cluster, but is not part of the configuration
-		orphans := diff(desired, current)
-		s.deleteRoleBindings(ctx, orphans)
-		promSuccess.WithLabelValues("delete-orphan").Add(float64(len(orphans)))
+	s.queue.Forget(key)
+	return true
+}
 
-		// Remove orphans from list of current role bindings
-		current = diff(orphans, current)
+// Synchronizes the desired state of a single namespace with the managed role bindings found in the informer cache,
+// and reports the outcome in the status of its GroupBindings
+func (s *Synchronizer) synchronizeNamespace(ctx context.Context, name string) error {
+	groupBindings, err := s.getGroupBindings(ctx, name)
+	if err != nil {
+		return err
+	}
 
-		// New role bindings to create
-		added := diff(current, desired)
+	var managed *corev1.Namespace
+	namespace, err := s.namespaceLister.Get(name)
+	switch {
+	case errors.IsNotFound(err):
+		log.Debugf("namespace %s no longer exists", name)
+	case err != nil:
+		return fmt.Errorf("unable to get namespace %s from cache: %s", name, err)
+	case isManaged(*namespace) || len(groupBindings) > 0:
+		managed = namespace
+	}
 
-		if err := s.createRoleBindings(ctx, added); err != nil {
-			continue
-		}
+	cached, err := s.roleBindingLister.RoleBindings(name).List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("unable to list managed rolebindings in namespace %s from cache: %s", name, err)
+	}
 
-		promSuccess.WithLabelValues("create-rolebinding").Add(float64(len(added)))
+	current := make([]v1.RoleBinding, 0, len(cached))
+	for _, roleBinding := range cached {
+		current = append(current, *roleBinding.DeepCopy())
+	}
 
-		// Add newly created role bindings to list of current role bindings in the cluster
-		current = append(current, added...)
+	// Generate desired rolebindings based on namespace annotations and GroupBindings
+	var desired []v1.RoleBinding
+	var results map[string]groupBindingResult
+	if managed != nil {
+		desired, results, err = s.getNamespaceRoleBindings(ctx, *managed, groupBindings)
+	}
 
-		s.updateRoleBindings(ctx, roleBindingsToUpdate(desired, current))
+	// Keep the existing role bindings untouched rather than treating them as orphans when the group lookup fails
+	if err != nil {
+		log.Errorf("unable to generate rolebindings for namespace %s: %s", name, err)
+		promStale.WithLabelValues(name).Set(1)
+		log.Warnf("group lookup failed for namespace %s, keeping %d existing rolebindings until next successful lookup", name, len(current))
+		s.updateGroupBindingStatuses(ctx, groupBindings, results, err)
+		return fmt.Errorf("namespace %s is stale", name)
+	}
+	promStale.DeleteLabelValues(name)
 
-		log.Debugf("sleeping for %s", s.UpdateInterval)
-		time.Sleep(s.UpdateInterval)
+	err = s.synchronizeRoleBindings(ctx, name, desired, current)
+	s.updateGroupBindingStatuses(ctx, groupBindings, results, err)
+	if err != nil {
+		return err
 	}
+
+	// The rest of the namespace is in sync, and failed GroupBindings are retried with backoff
+	if failed := failedGroupBindings(results); len(failed) > 0 {
+		return fmt.Errorf("unable to generate rolebindings for groupbindings %s", strings.Join(failed, ", "))
+	}
+
+	return nil
 }
 
-// Updates role binding by deleting and re-creating it because spec.roleRef.Name is immutable
-func (s *Synchronizer) updateRoleBindings(ctx context.Context, roleBindings []v1.RoleBinding) {
-	for _, roleBinding := range roleBindings {
-		if err := s.deleteRoleBinding(ctx, roleBinding); err != nil {
-			continue
+// Applies missing and changed role bindings and deletes orphans, so that current matches desired
+func (s *Synchronizer) synchronizeRoleBindings(ctx context.Context, namespace string, desired, current []v1.RoleBinding) error {
+	plan := planRoleBindings(desired, current)
+
+	if s.DryRun {
+		s.logPlan(namespace, plan)
+		return nil
+	}
+
+	// Orphans are deleted last, so that a temporary role binding left by a failed replace keeps its subjects' access
+	// until the role binding it stands in for is back
+	if err := s.applyRoleBindings(ctx, plan.Added); err != nil {
+		return err
+	}
+	promSuccess.WithLabelValues("create-rolebinding").Add(float64(len(plan.Added)))
+
+	if err := s.updateRoleBindings(ctx, plan.Updated, current); err != nil {
+		return err
+	}
+
+	if err := s.deleteRoleBindings(ctx, plan.Orphans); err != nil {
+		return err
+	}
+	promSuccess.WithLabelValues("delete-orphan").Add(float64(len(plan.Orphans)))
+
+	return nil
+}
+
+// Logs the planned changes in a namespace and exposes them as metrics instead of applying them
+func (s *Synchronizer) logPlan(namespace string, plan RoleBindingPlan) {
+	promPlanned.WithLabelValues(namespace, "delete").Set(float64(len(plan.Orphans)))
+	promPlanned.WithLabelValues(namespace, "create").Set(float64(len(plan.Added)))
+	promPlanned.WithLabelValues(namespace, "update").Set(float64(len(plan.Updated)))
+
+	if plan.isEmpty() {
+		log.Debugf("dry run: no changes planned for namespace %s", namespace)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"namespace": namespace,
+		"delete":    names(plan.Orphans),
+		"create":    names(plan.Added),
+		"update":    names(plan.Updated),
+	}).Info("dry run: planned rolebinding changes")
+}
+
+// Updates the role bindings to match the desired ones, keeping access to the namespace throughout
+func (s *Synchronizer) updateRoleBindings(ctx context.Context, desired, current []v1.RoleBinding) error {
+	for _, roleBinding := range desired {
+		match, err := getMatchingRoleBinding(roleBinding, current)
+		if err != nil {
+			return err
 		}
 
-		if err := s.createRoleBinding(ctx, roleBinding); err != nil {
-			continue
+		if roleBinding.RoleRef != match.RoleRef {
+			err = s.replaceRoleBinding(ctx, roleBinding, *match)
+		} else {
+			err = s.applyRoleBinding(ctx, roleBinding)
+		}
+
+		if err != nil {
+			return err
 		}
+
+		promSuccess.WithLabelValues("updated-rolebinding").Inc()
 	}
 
-	promSuccess.WithLabelValues("updated-rolebinding").Add(float64(len(roleBindings)))
+	return nil
 }
 
-func (s *Synchronizer) createRoleBindings(ctx context.Context, roleBindings []v1.RoleBinding) error {
+// Replaces the current role binding with the desired one, as spec.roleRef is immutable. A copy of the desired
+// role binding is created under a temporary name first, so that the subjects never lose access in between.
+func (s *Synchronizer) replaceRoleBinding(ctx context.Context, desired, current v1.RoleBinding) error {
+	temporary := *desired.DeepCopy()
+	temporary.Name = desired.Name + TemporaryRoleBindingSuffix
+
+	if err := s.applyRoleBinding(ctx, temporary); err != nil {
+		return err
+	}
+
+	if err := s.deleteRoleBinding(ctx, current); err != nil {
+		return err
+	}
+
+	if err := s.applyRoleBinding(ctx, desired); err != nil {
+		return err
+	}
+
+	return s.deleteRoleBinding(ctx, temporary)
+}
+
+func (s *Synchronizer) applyRoleBindings(ctx context.Context, roleBindings []v1.RoleBinding) error {
 	for _, binding := range roleBindings {
-		if err := s.createRoleBinding(ctx, binding); err != nil {
+		if err := s.applyRoleBinding(ctx, binding); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// Tells whether the role binding is managed by rbac-sync but has never been applied by it, i.e. its fields are still
+// owned by the manager that created or updated it before server-side apply
+func (s *Synchronizer) isLegacyRoleBinding(ctx context.Context, binding v1.RoleBinding) bool {
+	existing, err := s.Clientset.RbacV1().RoleBindings(binding.Namespace).Get(ctx, binding.Name, metav1.GetOptions{})
+	if err != nil || existing.Labels[ManagedLabel] != "true" {
+		return false
+	}
+
+	for _, entry := range existing.ManagedFields {
+		if entry.Manager == FieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (s *Synchronizer) deleteRoleBindings(ctx context.Context, roleBindings []v1.RoleBinding) error {
 	for _, binding := range roleBindings {
 		if err := s.deleteRoleBinding(ctx, binding); err != nil {
@@ -138,16 +466,33 @@ func (s *Synchronizer) deleteRoleBinding(ctx context.Context, roleBinding v1.Rol
 	return nil
 }
 
-func (s *Synchronizer) createRoleBinding(ctx context.Context, binding v1.RoleBinding) error {
-	_, err := s.Clientset.RbacV1().RoleBindings(binding.Namespace).Create(ctx, &binding, metav1.CreateOptions{})
+// Creates or updates the role binding with server-side apply. Fields owned by other managers are left alone,
+// and fields also set by another manager are reported as conflicts rather than overwritten. Role bindings created
+// before rbac-sync used server-side apply are taken over once.
+func (s *Synchronizer) applyRoleBinding(ctx context.Context, binding v1.RoleBinding) error {
+	_, err := s.Clientset.RbacV1().RoleBindings(binding.Namespace).Apply(ctx, roleBindingApplyConfiguration(binding), metav1.ApplyOptions{FieldManager: FieldManager})
+
+	if errors.IsConflict(err) && s.isLegacyRoleBinding(ctx, binding) {
+		log.Infof("taking over rolebinding %s in namespace %s, created before server-side apply", binding.Name, binding.Namespace)
+		_, err = s.Clientset.RbacV1().RoleBindings(binding.Namespace).Apply(ctx, roleBindingApplyConfiguration(binding), metav1.ApplyOptions{FieldManager: FieldManager, Force: true})
+		if err == nil {
+			promSuccess.WithLabelValues("takeover-rolebinding").Inc()
+		}
+	}
+
+	if errors.IsConflict(err) {
+		promErrors.WithLabelValues("apply-conflict").Inc()
+		log.Errorf("conflict applying rolebinding %s in namespace %s, fields are owned by another manager: %s", binding.Name, binding.Namespace, err)
+		return err
+	}
 
 	if err != nil {
-		promErrors.WithLabelValues("create-rolebinding").Inc()
-		log.Errorf("unable to create rolebinding %s in namespace %s: %s", binding.Name, binding.Namespace, err)
+		promErrors.WithLabelValues("apply-rolebinding").Inc()
+		log.Errorf("unable to apply rolebinding %s in namespace %s: %s", binding.Name, binding.Namespace, err)
 		return err
 	}
 
-	log.Debugf("created rolebinding: %s in namespace: %s", binding.Name, binding.Namespace)
+	log.Debugf("applied rolebinding: %s in namespace: %s", binding.Name, binding.Namespace)
 
 	return nil
 }
@@ -164,35 +509,229 @@ func (s *Synchronizer) getCurrentManagedRoleBindings(ctx context.Context) (roleB
 	return bindingList.Items, nil
 }
 
-func (s *Synchronizer) getDesiredRoleBindings(namespaces []corev1.Namespace) (rolebindings []v1.RoleBinding) {
+// Generates the desired role bindings for the given namespaces. Namespaces where the group lookup failed are
+// returned as stale, and their current role bindings should be kept as they are.
+func (s *Synchronizer) getDesiredRoleBindings(ctx context.Context, namespaces []corev1.Namespace) (rolebindings []v1.RoleBinding, stale []string) {
 	for _, ns := range namespaces {
-		group := ns.Annotations[GroupNameAnnotation]
-		members, err := s.IAMClient.getMembers(group)
+		groupBindings, err := s.getGroupBindings(ctx, ns.Name)
+		if err == nil {
+			var desired []v1.RoleBinding
+			if desired, _, err = s.getNamespaceRoleBindings(ctx, ns, groupBindings); err == nil {
+				rolebindings = append(rolebindings, desired...)
+				continue
+			}
+		}
+
+		log.Errorf("unable to generate rolebindings for namespace %s: %s", ns.Name, err)
+		stale = append(stale, ns.Name)
+	}
+
+	return
+}
+
+// Generates the desired role bindings of a namespace from its annotations and GroupBindings. A GroupBinding that
+// fails keeps the role bindings of its last successful synchronization, and only fails in its result, while the
+// annotations failing fail the whole namespace.
+func (s *Synchronizer) getNamespaceRoleBindings(ctx context.Context, ns corev1.Namespace, groupBindings []GroupBinding) (rolebindings []v1.RoleBinding, results map[string]groupBindingResult, err error) {
+	bindings, err := s.getBindings(ns)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	filtered := map[string]int{}
+	generated := map[string]string{}
+	// Returns an error if a role binding is generated for two bindings
+	generate := func(desired []v1.RoleBinding, dropped map[string]int, source string) error {
+		for _, rolebinding := range desired {
+			if other, ok := generated[rolebinding.Name]; ok {
+				promErrors.WithLabelValues("duplicate-rolebinding").Inc()
+				return fmt.Errorf("rolebinding %s is generated for both %s and %s, they need different prefixes", rolebinding.Name, other, source)
+			}
+			generated[rolebinding.Name] = source
+		}
+		for reason, count := range dropped {
+			filtered[reason] += count
+		}
+
+		rolebindings = append(rolebindings, desired...)
+		return nil
+	}
+
+	for _, binding := range bindings {
+		desired, dropped, err := s.getBindingRoleBindings(ctx, ns.Name, binding)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := generate(desired, dropped, "group "+binding.Group); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	results = map[string]groupBindingResult{}
+	for _, groupBinding := range groupBindings {
+		desired, dropped, err := s.getGroupBindingRoleBindings(ctx, ns, groupBinding)
+		if err == nil {
+			err = generate(desired, dropped, "groupbinding "+groupBinding.Name)
+		}
 
 		if err != nil {
-			log.Errorf("unable to get members for group %s: %s", group, err)
+			log.Errorf("unable to generate rolebindings for groupbinding %s in namespace %s: %s", groupBinding.Name, ns.Name, err)
+			results[groupBinding.Name] = groupBindingResult{Err: err}
 			continue
 		}
 
-		rolebindingName := ensureVal(ns.Annotations[RolebindingPrefixAnnotation], s.DefaultRoleBindingPrefix)
-		roleNames := ensureVal(ns.Annotations[RolesAnnotation], s.DefaultRoles)
+		results[groupBinding.Name] = groupBindingResult{Members: countSubjects(desired), RoleBindings: names(desired)}
+	}
+
+	// Kept role bindings that another binding generates by now belong to that one
+	for _, groupBinding := range groupBindings {
+		if results[groupBinding.Name].Err == nil {
+			continue
+		}
 
-		for _, role := range strings.Split(roleNames, ",") {
-			rolebindings = append(rolebindings, roleBinding(rolebindingName, ns.Name, role, members))
+		kept, err := s.getLastRoleBindings(ctx, groupBinding)
+		if err != nil {
+			return nil, results, err
+		}
+		for _, rolebinding := range kept {
+			if _, ok := generated[rolebinding.Name]; !ok {
+				generated[rolebinding.Name] = "groupbinding " + groupBinding.Name
+				rolebindings = append(rolebindings, rolebinding)
+			}
 		}
 	}
 
-	return
+	for reason, count := range filtered {
+		promFilteredMembers.WithLabelValues(ns.Name, reason).Set(float64(count))
+	}
+
+	return rolebindings, results, nil
 }
 
-func (s *Synchronizer) getTargetNamespaces(ctx context.Context) (managedNamespaces []corev1.Namespace) {
+// Generates the role bindings of a GroupBinding
+func (s *Synchronizer) getGroupBindingRoleBindings(ctx context.Context, ns corev1.Namespace, groupBinding GroupBinding) ([]v1.RoleBinding, map[string]int, error) {
+	binding, err := s.groupBindingBinding(ns, groupBinding)
+	if err != nil {
+		promErrors.WithLabelValues("invalid-groupbinding").Inc()
+		return nil, nil, fmt.Errorf("invalid groupbinding: %s", err)
+	}
+
+	return s.getBindingRoleBindings(ctx, ns.Name, binding)
+}
+
+// Generates the role bindings of a group, and returns the number of members left out by the filter by reason
+func (s *Synchronizer) getBindingRoleBindings(ctx context.Context, namespace string, binding Binding) (rolebindings []v1.RoleBinding, dropped map[string]int, err error) {
+	// The group is bound as it is, so there are no members to filter or map to roles
+	if binding.SubjectMode == SubjectModeGroup {
+		_, name := splitProvider(binding.Group)
+		subjects, err := binding.Templates.subjects([]Member{{Email: name, Type: MemberTypeGroup}})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, role := range binding.Roles {
+			rolebindings = append(rolebindings, templatedRoleBinding(binding.Prefix, namespace, role, subjects, binding.Templates))
+		}
+		return rolebindings, nil, nil
+	}
+
+	members, err := s.IAMClient.getMembers(ctx, binding.Group, LookupOptions{
+		DirectMembersOnly: binding.DirectMembersOnly,
+		IncludeGroups:     binding.SubjectMode == SubjectModeHybrid,
+	})
+	switch {
+	case isGroupNotFound(err) && s.EmptyMissingGroups:
+		// The group is gone for good, so its members should lose access rather than keep it as for a failed lookup
+		promErrors.WithLabelValues("group-not-found").Inc()
+		log.Warnf("group %s not found, binding no members in namespace %s: %s", binding.Group, namespace, err)
+		members = nil
+	case err != nil:
+		return nil, nil, fmt.Errorf("unable to get members for group %s: %s", binding.Group, err)
+	}
+
+	members, dropped = binding.Filter.apply(members)
+
+	if len(binding.MemberRoles) > 0 {
+		bound := binding.MemberRoles.bind(members)
+		for _, role := range binding.MemberRoles.clusterRoles() {
+			subjects, err := binding.Templates.subjects(bound[role])
+			if err != nil {
+				return nil, nil, err
+			}
+			rolebindings = append(rolebindings, templatedRoleBinding(binding.Prefix, namespace, role, subjects, binding.Templates))
+		}
+		return rolebindings, dropped, nil
+	}
+
+	subjects, err := binding.Templates.subjects(members)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, role := range binding.Roles {
+		rolebindings = append(rolebindings, templatedRoleBinding(binding.Prefix, namespace, role, subjects, binding.Templates))
+	}
+
+	return rolebindings, dropped, nil
+}
+
+// Returns the subject templates of the provider of the group, overridden by the annotations of the namespace
+func (s *Synchronizer) subjectTemplates(ns corev1.Namespace, group string) (templates SubjectTemplates, err error) {
+	provider, _ := splitProvider(group)
+	templates, ok := s.SubjectTemplates[ensureVal(provider, s.DefaultProvider)]
+	if !ok {
+		templates = s.SubjectTemplates[""]
+	}
+
+	if text, ok := ns.Annotations[UserSubjectTemplateAnnotation]; ok {
+		if templates.User, err = parseSubjectTemplate("user", text); err != nil {
+			return templates, fmt.Errorf("invalid %s annotation: %s", UserSubjectTemplateAnnotation, err)
+		}
+	}
+	if text, ok := ns.Annotations[GroupSubjectTemplateAnnotation]; ok {
+		if templates.Group, err = parseSubjectTemplate("group", text); err != nil {
+			return templates, fmt.Errorf("invalid %s annotation: %s", GroupSubjectTemplateAnnotation, err)
+		}
+	}
+
+	return templates, nil
+}
+
+// Returns no member role mapping when a binding names its roles, or else the mapping of the namespace annotation or
+// the default one. An empty mapping binds every member to the same roles.
+func (s *Synchronizer) memberRoles(ns corev1.Namespace, roles []string) (RoleMapping, error) {
+	if len(roles) > 0 {
+		return nil, nil
+	}
+
+	if mapping, ok := ns.Annotations[MemberRolesAnnotation]; ok {
+		return ParseRoleMapping(mapping)
+	}
+
+	return s.DefaultMemberRoles, nil
+}
+
+// Returns the namespaces with rbac-sync annotations or GroupBindings
+func (s *Synchronizer) getTargetNamespaces(ctx context.Context) (managedNamespaces []corev1.Namespace, err error) {
 	namespaces, err := s.Clientset.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		log.Errorf("unable to get all namespaces: %s", err)
+		promErrors.WithLabelValues("get-namespaces").Inc()
+		return nil, fmt.Errorf("unable to get all namespaces: %s", err)
+	}
+
+	groupBindings, err := s.getGroupBindings(ctx, metav1.NamespaceAll)
+	if err != nil {
+		return nil, err
+	}
+
+	withGroupBindings := map[string]bool{}
+	for _, groupBinding := range groupBindings {
+		withGroupBindings[groupBinding.Namespace] = true
 	}
 
 	for _, namespace := range namespaces.Items {
-		if len(namespace.Annotations[GroupNameAnnotation]) > 0 {
+		if isManaged(namespace) || withGroupBindings[namespace.Name] {
 			managedNamespaces = append(managedNamespaces, namespace)
 		}
 	}
@@ -200,6 +739,23 @@ func (s *Synchronizer) getTargetNamespaces(ctx context.Context) (managedNamespac
 	return
 }
 
+// A namespace is managed by rbac-sync when it has the group name or the bindings annotation
+func isManaged(namespace corev1.Namespace) bool {
+	return len(namespace.Annotations[GroupNameAnnotation]) > 0 || len(strings.TrimSpace(namespace.Annotations[BindingsAnnotation])) > 0
+}
+
+// Returns true if any of the annotations read by rbac-sync differ between the two namespaces
+func hasChangedAnnotations(old, new *corev1.Namespace) bool {
+	for _, annotation := range []string{GroupNameAnnotation, RolesAnnotation, RolebindingPrefixAnnotation, DirectMembersOnlyAnnotation,
+		MemberStatusesAnnotation, MemberTypesAnnotation, MemberDomainsAnnotation, MemberRolesAnnotation,
+		SubjectModeAnnotation, UserSubjectTemplateAnnotation, GroupSubjectTemplateAnnotation, BindingsAnnotation} {
+		if old.Annotations[annotation] != new.Annotations[annotation] {
+			return true
+		}
+	}
+	return false
+}
+
 func ensureVal(val string, fallback string) string {
 	if len(strings.TrimSpace(val)) > 0 {
 		return val
@@ -2,40 +2,158 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	corev1 "k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	rbacapplyv1 "k8s.io/client-go/applyconfigurations/rbac/v1"
 	"k8s.io/client-go/kubernetes/fake"
+	rbacclientv1 "k8s.io/client-go/kubernetes/typed/rbac/v1"
+	k8stesting "k8s.io/client-go/testing"
 
 	"testing"
 )
 
+// The fake clientset does not support server-side apply, so apply patches for role bindings are handled as a
+// create or an update of the subjects and labels. Changing the immutable roleRef is rejected like the API server does.
+func newFakeClientset(objects ...runtime.Object) *fake.Clientset {
+	clientSet := fake.NewSimpleClientset(objects...)
+	tracker := clientSet.Tracker()
+	resource := rbacv1.SchemeGroupVersion.WithResource("rolebindings")
+
+	clientSet.PrependReactor("patch", "rolebindings", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+
+		applied := &rbacv1.RoleBinding{}
+		if err := json.Unmarshal(patch.GetPatch(), applied); err != nil {
+			return true, nil, err
+		}
+
+		existing, err := tracker.Get(resource, patch.GetNamespace(), patch.GetName())
+		if errors.IsNotFound(err) {
+			return true, applied, tracker.Create(resource, applied, patch.GetNamespace())
+		}
+		if err != nil {
+			return true, nil, err
+		}
+
+		updated := existing.(*rbacv1.RoleBinding).DeepCopy()
+		if updated.RoleRef != applied.RoleRef {
+			return true, nil, errors.NewInvalid(rbacv1.SchemeGroupVersion.WithKind("RoleBinding").GroupKind(), patch.GetName(), nil)
+		}
+
+		updated.Subjects = applied.Subjects
+		if updated.Labels == nil {
+			updated.Labels = make(map[string]string)
+		}
+		for key, value := range applied.Labels {
+			updated.Labels[key] = value
+		}
+		return true, updated, tracker.Update(resource, updated, patch.GetNamespace())
+	})
+
+	return clientSet
+}
+
+// The fake clientset neither tracks managed fields nor passes apply options to its reactors. This one records the
+// role bindings applied by rbac-sync as owned by it, and rejects applying subjects owned by another manager unless
+// forced, like the API server does.
+type fieldManagingClientset struct {
+	*fake.Clientset
+	forced []string
+}
+
+func (c *fieldManagingClientset) RbacV1() rbacclientv1.RbacV1Interface {
+	return fieldManagingRbac{RbacV1Interface: c.Clientset.RbacV1(), clientset: c}
+}
+
+type fieldManagingRbac struct {
+	rbacclientv1.RbacV1Interface
+	clientset *fieldManagingClientset
+}
+
+func (r fieldManagingRbac) RoleBindings(namespace string) rbacclientv1.RoleBindingInterface {
+	return fieldManagingRoleBindings{RoleBindingInterface: r.RbacV1Interface.RoleBindings(namespace), clientset: r.clientset}
+}
+
+type fieldManagingRoleBindings struct {
+	rbacclientv1.RoleBindingInterface
+	clientset *fieldManagingClientset
+}
+
+func (r fieldManagingRoleBindings) Apply(ctx context.Context, roleBinding *rbacapplyv1.RoleBindingApplyConfiguration, opts metav1.ApplyOptions) (*rbacv1.RoleBinding, error) {
+	existing, err := r.Get(ctx, *roleBinding.Name, metav1.GetOptions{})
+	if err == nil && !opts.Force && !ownsFields(existing.ManagedFields, opts.FieldManager) {
+		return nil, errors.NewConflict(rbacv1.Resource("rolebindings"), *roleBinding.Name, fmt.Errorf("subjects are owned by another manager"))
+	}
+	if opts.Force {
+		r.clientset.forced = append(r.clientset.forced, *roleBinding.Name)
+	}
+
+	if _, err := r.RoleBindingInterface.Apply(ctx, roleBinding, opts); err != nil {
+		return nil, err
+	}
+
+	applied, err := r.Get(ctx, *roleBinding.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	applied.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: opts.FieldManager, Operation: metav1.ManagedFieldsOperationApply}}
+	return r.Update(ctx, applied, metav1.UpdateOptions{})
+}
+
+func ownsFields(managedFields []metav1.ManagedFieldsEntry, fieldManager string) bool {
+	for _, entry := range managedFields {
+		if entry.Manager != fieldManager || entry.Operation != metav1.ManagedFieldsOperationApply {
+			return false
+		}
+	}
+	return true
+}
+
 func TestSynchronizer(t *testing.T) {
 	ctx := context.Background()
-	synchronizer := NewSynchronizer(fake.NewSimpleClientset(), MockAdminService{}, time.Second*10, "testuser@test.domain", "testing", "", "")
+	synchronizer := NewSynchronizer(newFakeClientset(), MockAdminService{}, time.Second*10, "testuser@test.domain", "testing", "", "")
 
 	t.Run("creates new role bindings", func(t *testing.T) {
-		rolebindings := []rbacv1.RoleBinding{roleBinding("a", "ns1", "admin", []string{"x", "y", "z"}),
-			roleBinding("b", "ns2", "admin", []string{"x", "y", "z"})}
+		rolebindings := []rbacv1.RoleBinding{roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"})),
+			roleBinding("b", "ns2", "admin", subjects([]string{"x", "y", "z"}))}
 
-		err := synchronizer.createRoleBindings(ctx, rolebindings)
+		err := synchronizer.applyRoleBindings(ctx, rolebindings)
 		assert.NoError(t, err)
 	})
 
-	t.Run("error when creating identical role bindings", func(t *testing.T) {
-		rolebindingsWithError := []rbacv1.RoleBinding{roleBinding("a", "ns1", "admin", []string{"x", "y", "z"}),
-			roleBinding("a", "ns1", "admin", []string{"x", "y", "z"})}
+	t.Run("applying identical role bindings is idempotent", func(t *testing.T) {
+		rolebindings := []rbacv1.RoleBinding{roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"})),
+			roleBinding("a", "ns1", "admin", subjects([]string{"x", "y", "z"}))}
 
-		error := synchronizer.createRoleBindings(ctx, rolebindingsWithError)
-		assert.Error(t, error)
+		err := synchronizer.applyRoleBindings(ctx, rolebindings)
+		assert.NoError(t, err)
+	})
+
+	t.Run("error when applying a changed role", func(t *testing.T) {
+		changed := roleBinding("a", "ns1", "view", subjects([]string{"x", "y", "z"}))
+		changed.Name = "a-admin"
+
+		err := synchronizer.applyRoleBinding(ctx, changed)
+		assert.Error(t, err)
 	})
 
 	t.Run("skips non-existent groups", func(t *testing.T) {
-		rb := synchronizer.getDesiredRoleBindings([]corev1.Namespace{{
+		rb, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{{
 			ObjectMeta: metav1.ObjectMeta{
+				Name:        "broken",
 				Annotations: map[string]string{"rbac-sync.nais.io/group-name": "nonexistent"},
 			}}, {
 			ObjectMeta: metav1.ObjectMeta{
@@ -43,10 +161,11 @@ func TestSynchronizer(t *testing.T) {
 			}}})
 
 		assert.Equal(t, len(rb), 1, "contains single rolebinding for working ns")
+		assert.Equal(t, []string{"broken"}, stale)
 	})
 
 	t.Run("creates multiple rolebindings when multiple roles are requested", func(t *testing.T) {
-		rbs := synchronizer.getDesiredRoleBindings([]corev1.Namespace{{
+		rbs, _ := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{{
 			ObjectMeta: metav1.ObjectMeta{
 				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com", RolesAnnotation: "a,b", RolebindingPrefixAnnotation: "prefix"},
 			}}})
@@ -55,4 +174,417 @@ func TestSynchronizer(t *testing.T) {
 		assert.Equal(t, rbs[0].Name, "prefix-a")
 		assert.Equal(t, rbs[1].Name, "prefix-b")
 	})
+
+	t.Run("binds members to roles by their role in the group", func(t *testing.T) {
+		synchronizer := *synchronizer
+		synchronizer.DefaultMemberRoles, _ = ParseRoleMapping("OWNER=admin,*=view")
+		rbs, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "default",
+				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com", RolebindingPrefixAnnotation: "prefix"},
+			}}, {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "overridden",
+				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com", RolebindingPrefixAnnotation: "prefix", MemberRolesAnnotation: "OWNER=edit,MEMBER=view"},
+			}}, {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "roles",
+				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com", RolebindingPrefixAnnotation: "prefix", RolesAnnotation: "a"},
+			}}, {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "invalid",
+				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com", MemberRolesAnnotation: "ADMIN=admin"},
+			}}})
+
+		assert.Equal(t, []string{"invalid"}, stale)
+		assert.Equal(t, []string{"prefix-admin", "prefix-view", "prefix-edit", "prefix-view", "prefix-a"}, names(rbs))
+		assert.Equal(t, []string{"a@b.com"}, subjectNames(rbs[0].Subjects))
+		assert.Equal(t, []string{"d@e.fi", "h@i.jp"}, subjectNames(rbs[1].Subjects))
+		assert.Equal(t, []string{"a@b.com"}, subjectNames(rbs[2].Subjects))
+		assert.Empty(t, rbs[3].Subjects, "members without a mapped role are not bound")
+		assert.Equal(t, []string{"a@b.com", "d@e.fi", "h@i.jp"}, subjectNames(rbs[4].Subjects))
+	})
+
+	t.Run("subject modes", func(t *testing.T) {
+		iamClient := &countingIAMClient{}
+		synchronizer := *synchronizer
+		synchronizer.IAMClient = iamClient
+		synchronizer.SubjectMode = SubjectModeGroup
+		rbs, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "group",
+				Annotations: map[string]string{GroupNameAnnotation: "google:team@bar.com", RolesAnnotation: "admin", RolebindingPrefixAnnotation: "prefix"},
+			}}, {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "hybrid",
+				Annotations: map[string]string{GroupNameAnnotation: "team@bar.com", RolesAnnotation: "admin", RolebindingPrefixAnnotation: "prefix", SubjectModeAnnotation: SubjectModeHybrid},
+			}}, {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "invalid",
+				Annotations: map[string]string{GroupNameAnnotation: "team@bar.com", SubjectModeAnnotation: "everyone"},
+			}}})
+
+		assert.Equal(t, []string{"invalid"}, stale)
+		assert.Len(t, rbs, 2)
+		assert.Equal(t, []rbacv1.Subject{groupSubject("team@bar.com")}, rbs[0].Subjects, "group is bound without its provider prefix")
+		assert.Equal(t, int32(1), iamClient.lookups.Load(), "group mode does not look up members")
+		assert.Equal(t, []string{"a@team@bar.com"}, subjectNames(rbs[1].Subjects))
+	})
+
+	t.Run("subject templates by provider and namespace", func(t *testing.T) {
+		synchronizer := *synchronizer
+		synchronizer.DefaultProvider = ProviderGoogle
+		synchronizer.SubjectMode = SubjectModeHybrid
+		synchronizer.SubjectTemplates, _ = NewSubjectTemplatesByProvider(
+			subjectTemplateFlag{"": "oidc:{{ .Email | lower }}", ProviderAzure: "aad:{{ .Email }}"},
+			subjectTemplateFlag{"": "oidc:{{ .Email }}"})
+		iamClient := NewCompositeIAMClient(ProviderGoogle)
+		iamClient.Backends[ProviderGoogle] = &countingIAMClient{}
+		iamClient.Backends[ProviderAzure] = &countingIAMClient{}
+		synchronizer.IAMClient = iamClient
+		namespace := func(name string, annotations map[string]string) corev1.Namespace {
+			annotations[RolesAnnotation], annotations[RolebindingPrefixAnnotation] = "admin", "prefix"
+			return corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations}}
+		}
+
+		rbs, stale := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{
+			namespace("google", map[string]string{GroupNameAnnotation: "Team@bar.com"}),
+			namespace("azure", map[string]string{GroupNameAnnotation: "azure:Team@bar.com"}),
+			namespace("group", map[string]string{GroupNameAnnotation: "azure:Team@bar.com", SubjectModeAnnotation: SubjectModeGroup}),
+			namespace("annotated", map[string]string{GroupNameAnnotation: "Team@bar.com", UserSubjectTemplateAnnotation: ""}),
+			namespace("invalid", map[string]string{GroupNameAnnotation: "Team@bar.com", GroupSubjectTemplateAnnotation: "{{ .Group }}"}),
+		})
+
+		assert.Equal(t, []string{"invalid"}, stale)
+		assert.Len(t, rbs, 4)
+		assert.Equal(t, []string{"oidc:a@team@bar.com"}, subjectNames(rbs[0].Subjects))
+		assert.Equal(t, []string{"aad:a@Team@bar.com"}, subjectNames(rbs[1].Subjects))
+		assert.Equal(t, []rbacv1.Subject{groupSubject("oidc:Team@bar.com")}, rbs[2].Subjects)
+		assert.Equal(t, []string{"a@Team@bar.com"}, subjectNames(rbs[3].Subjects))
+		assert.Equal(t, "user: oidc:{{.Email | lower}}, group: oidc:{{.Email}}", rbs[0].Annotations[SubjectTemplatesAnnotation])
+		assert.Equal(t, "user: {{ .Email }}, group: oidc:{{.Email}}", rbs[3].Annotations[SubjectTemplatesAnnotation])
+	})
+
+	t.Run("binds nested groups as groups in hybrid mode", func(t *testing.T) {
+		synchronizer := *synchronizer
+		synchronizer.SubjectMode = SubjectModeHybrid
+		synchronizer.IAMClient, _ = newFileService(ctx, "test", func(context.Context) ([]byte, error) {
+			return []byte(testGroups), nil
+		})
+		rbs, _ := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "hybrid",
+				Annotations: map[string]string{GroupNameAnnotation: "team@example.com", RolesAnnotation: "admin", RolebindingPrefixAnnotation: "prefix"},
+			}}})
+
+		assert.Len(t, rbs, 1)
+		assert.Equal(t, append(subjects([]string{"a@example.com", "b@example.com"}), groupSubject("platform@example.com")), rbs[0].Subjects)
+	})
+
+	t.Run("leaves filtered members out of the rolebindings", func(t *testing.T) {
+		synchronizer := *synchronizer
+		synchronizer.MemberFilter = NewMemberFilter("", "", "b.com")
+		rbs, _ := synchronizer.getDesiredRoleBindings(ctx, []corev1.Namespace{{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "filtered",
+				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com"},
+			}}, {
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "overridden",
+				Annotations: map[string]string{GroupNameAnnotation: "foo@bar.com", MemberDomainsAnnotation: "e.fi,i.jp"},
+			}}})
+
+		assert.Len(t, rbs, 2)
+		assert.Equal(t, []string{"a@b.com"}, subjectNames(rbs[0].Subjects))
+		assert.Equal(t, []string{"d@e.fi", "h@i.jp"}, subjectNames(rbs[1].Subjects))
+		assert.Equal(t, float64(2), testutil.ToFloat64(promFilteredMembers.WithLabelValues("filtered", FilterReasonDomain)))
+		assert.Equal(t, float64(0), testutil.ToFloat64(promFilteredMembers.WithLabelValues("filtered", FilterReasonStatus)))
+	})
+}
+
+func TestSynchronizerRun(t *testing.T) {
+	ctx := context.Background()
+	clientSet := newFakeClientset()
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go synchronizer.Run(stopCh, 1)
+
+	roleBindingExists := func() bool {
+		_, err := clientSet.RbacV1().RoleBindings("team").Get(ctx, "prefix-admin", metav1.GetOptions{})
+		return err == nil
+	}
+
+	t.Run("creates role binding when namespace is annotated", func(t *testing.T) {
+		_, err := clientSet.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "team",
+				Annotations: map[string]string{GroupNameAnnotation: "team@acme.no"},
+			}}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+
+		assert.Eventually(t, roleBindingExists, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("recreates role binding when deleted by hand", func(t *testing.T) {
+		err := clientSet.RbacV1().RoleBindings("team").Delete(ctx, "prefix-admin", metav1.DeleteOptions{})
+		assert.NoError(t, err)
+
+		assert.Eventually(t, roleBindingExists, 5*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("removes role binding when annotation is removed", func(t *testing.T) {
+		ns, err := clientSet.CoreV1().Namespaces().Get(ctx, "team", metav1.GetOptions{})
+		assert.NoError(t, err)
+
+		ns.Annotations = nil
+		_, err = clientSet.CoreV1().Namespaces().Update(ctx, ns, metav1.UpdateOptions{})
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool { return !roleBindingExists() }, 5*time.Second, 50*time.Millisecond)
+	})
+}
+
+// Blocks every lookup until it is cancelled
+type blockingIAMClient struct {
+	started chan struct{}
+}
+
+func (b blockingIAMClient) getMembers(ctx context.Context, _ string, _ LookupOptions) ([]Member, error) {
+	select {
+	case b.started <- struct{}{}:
+	default:
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSynchronizerCancelsLookupsWhenStopping(t *testing.T) {
+	clientSet := newFakeClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "team",
+			Annotations: map[string]string{GroupNameAnnotation: "team@acme.no"},
+		}})
+	client := blockingIAMClient{started: make(chan struct{}, 1)}
+	synchronizer := NewSynchronizer(clientSet, client, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+
+	stopCh := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		synchronizer.Run(stopCh, 1)
+		close(stopped)
+	}()
+
+	select {
+	case <-client.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no lookup was started")
+	}
+
+	close(stopCh)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping waits for the lookup in progress")
+	}
+}
+
+func TestSynchronizerKeepsRoleBindingsWhenGroupLookupFails(t *testing.T) {
+	ctx := context.Background()
+	existing := roleBinding("prefix", "broken", "admin", subjects([]string{"a@b.com"}))
+	clientSet := newFakeClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "broken",
+			Annotations: map[string]string{GroupNameAnnotation: "nonexistent"},
+		}}, &existing)
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go synchronizer.Run(stopCh, 1)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(promStale.WithLabelValues("broken")) == 1
+	}, 5*time.Second, 50*time.Millisecond, "namespace is marked stale")
+
+	roleBindings, err := clientSet.RbacV1().RoleBindings("broken").List(ctx, metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, roleBindings.Items, 1)
+	assert.Equal(t, existing.Subjects, roleBindings.Items[0].Subjects)
+
+	for _, action := range clientSet.Actions() {
+		assert.NotEqual(t, "delete", action.GetVerb(), "nothing is deleted")
+	}
+}
+
+func TestSynchronizerKeepsRoleBindingsOfMissingGroups(t *testing.T) {
+	ctx := context.Background()
+	existing := roleBinding("prefix", "missing", "admin", subjects([]string{"a@b.com"}))
+	clientSet := newFakeClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "missing",
+			Annotations: map[string]string{GroupNameAnnotation: "deleted"},
+		}}, &existing)
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go synchronizer.Run(stopCh, 1)
+
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(promStale.WithLabelValues("missing")) == 1
+	}, 5*time.Second, 50*time.Millisecond, "namespace is marked stale")
+
+	roleBinding, err := clientSet.RbacV1().RoleBindings("missing").Get(ctx, "prefix-admin", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, existing.Subjects, roleBinding.Subjects)
+}
+
+func TestSynchronizerEmptiesRoleBindingsOfDeletedGroups(t *testing.T) {
+	ctx := context.Background()
+	existing := roleBinding("prefix", "deleted", "admin", subjects([]string{"a@b.com"}))
+	clientSet := newFakeClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "deleted",
+			Annotations: map[string]string{GroupNameAnnotation: "deleted"},
+		}}, &existing)
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+	synchronizer.EmptyMissingGroups = true
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go synchronizer.Run(stopCh, 1)
+
+	assert.Eventually(t, func() bool {
+		roleBinding, err := clientSet.RbacV1().RoleBindings("deleted").Get(ctx, "prefix-admin", metav1.GetOptions{})
+		return err == nil && len(roleBinding.Subjects) == 0
+	}, 5*time.Second, 50*time.Millisecond, "members of the deleted group lose access")
+	assert.Equal(t, float64(0), testutil.ToFloat64(promStale.WithLabelValues("deleted")))
+}
+
+func TestSynchronizerDryRun(t *testing.T) {
+	ctx := context.Background()
+	orphan := roleBinding("old", "team", "admin", subjects([]string{"a@b.com"}))
+	changed := roleBinding("prefix", "team", "view", subjects([]string{"a@b.com"}))
+	clientSet := newFakeClientset(&orphan, &changed)
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+	synchronizer.DryRun = true
+
+	desired := []rbacv1.RoleBinding{
+		roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com"})),
+		roleBinding("prefix", "team", "view", subjects([]string{"a@b.com", "d@e.fi"})),
+	}
+
+	err := synchronizer.synchronizeRoleBindings(ctx, "team", desired, []rbacv1.RoleBinding{orphan, changed})
+	assert.NoError(t, err)
+
+	for _, action := range clientSet.Actions() {
+		assert.Failf(t, "unexpected write in dry run mode", "%s %s", action.GetVerb(), action.GetResource().Resource)
+	}
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(promPlanned.WithLabelValues("team", "delete")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(promPlanned.WithLabelValues("team", "create")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(promPlanned.WithLabelValues("team", "update")))
+}
+
+func TestSynchronizerUpdatesRoleBindings(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("updates subjects in place", func(t *testing.T) {
+		current := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com"}))
+		clientSet := newFakeClientset(&current)
+		synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+		desired := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com", "d@e.fi"}))
+
+		err := synchronizer.updateRoleBindings(ctx, []rbacv1.RoleBinding{desired}, []rbacv1.RoleBinding{current})
+		assert.NoError(t, err)
+
+		updated, err := clientSet.RbacV1().RoleBindings("team").Get(ctx, "prefix-admin", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, desired.Subjects, updated.Subjects)
+
+		for _, action := range clientSet.Actions() {
+			assert.NotEqual(t, "delete", action.GetVerb())
+		}
+	})
+
+	t.Run("replaces role binding through a temporary one when role has changed", func(t *testing.T) {
+		current := roleBinding("prefix", "team", "view", subjects([]string{"a@b.com"}))
+		current.Name = "prefix-admin"
+		clientSet := newFakeClientset(&current)
+		synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+		desired := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com"}))
+
+		err := synchronizer.updateRoleBindings(ctx, []rbacv1.RoleBinding{desired}, []rbacv1.RoleBinding{current})
+		assert.NoError(t, err)
+
+		roleBindings, err := clientSet.RbacV1().RoleBindings("team").List(ctx, metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, roleBindings.Items, 1)
+		assert.Equal(t, "prefix-admin", roleBindings.Items[0].Name)
+		assert.Equal(t, "admin", roleBindings.Items[0].RoleRef.Name)
+
+		var verbs []string
+		for _, action := range clientSet.Actions() {
+			if action.GetVerb() != "list" {
+				verbs = append(verbs, action.GetVerb())
+			}
+		}
+		assert.Equal(t, []string{"patch", "delete", "patch", "delete"}, verbs, "temporary role binding is applied before the old one is deleted")
+	})
+
+	t.Run("temporary role binding left by a failed replace is deleted after the desired one is back", func(t *testing.T) {
+		temporary := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com"}))
+		temporary.Name = "prefix-admin" + TemporaryRoleBindingSuffix
+		clientSet := newFakeClientset(&temporary)
+		synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "admin", "prefix")
+		desired := roleBinding("prefix", "team", "admin", subjects([]string{"a@b.com"}))
+
+		err := synchronizer.synchronizeRoleBindings(ctx, "team", []rbacv1.RoleBinding{desired}, []rbacv1.RoleBinding{temporary})
+		assert.NoError(t, err)
+
+		var verbs []string
+		for _, action := range clientSet.Actions() {
+			verbs = append(verbs, action.GetVerb())
+		}
+		assert.Equal(t, []string{"patch", "delete"}, verbs)
+	})
+}
+
+func TestSynchronizerTakesOverLegacyRoleBindings(t *testing.T) {
+	ctx := context.Background()
+	legacy := roleBinding("a", "ns1", "admin", subjects([]string{"x"}))
+	legacy.ManagedFields = []metav1.ManagedFieldsEntry{{Manager: "rbac-sync", Operation: metav1.ManagedFieldsOperationUpdate}}
+	shared := roleBinding("b", "ns1", "admin", subjects([]string{"x"}))
+	shared.ManagedFields = []metav1.ManagedFieldsEntry{
+		{Manager: FieldManager, Operation: metav1.ManagedFieldsOperationApply},
+		{Manager: "kubectl-edit", Operation: metav1.ManagedFieldsOperationUpdate},
+	}
+	clientSet := &fieldManagingClientset{Clientset: newFakeClientset(&legacy, &shared)}
+	synchronizer := NewSynchronizer(clientSet, MockAdminService{}, time.Hour, "testuser@test.domain", "testing", "", "")
+
+	t.Run("role bindings created before server-side apply are taken over", func(t *testing.T) {
+		err := synchronizer.applyRoleBinding(ctx, roleBinding("a", "ns1", "admin", subjects([]string{"x", "y"})))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a-admin"}, clientSet.forced)
+
+		updated, err := clientSet.RbacV1().RoleBindings("ns1").Get(ctx, "a-admin", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"x", "y"}, subjectNames(updated.Subjects))
+
+		err = synchronizer.applyRoleBinding(ctx, roleBinding("a", "ns1", "admin", subjects([]string{"x"})))
+		assert.NoError(t, err)
+		assert.Len(t, clientSet.forced, 1, "taken over once")
+	})
+
+	t.Run("conflicts with other managers are reported", func(t *testing.T) {
+		err := synchronizer.applyRoleBinding(ctx, roleBinding("b", "ns1", "admin", subjects([]string{"x", "y"})))
+		assert.True(t, errors.IsConflict(err))
+		assert.Len(t, clientSet.forced, 1)
+
+		unchanged, err := clientSet.RbacV1().RoleBindings("ns1").Get(ctx, "b-admin", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"x"}, subjectNames(unchanged.Subjects))
+	})
 }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"golang.org/x/oauth2"
+	admin "google.golang.org/api/admin/directory/v1"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+const (
+	GoogleTokenURL = "https://oauth2.googleapis.com/token"
+	jwtBearerGrant = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+)
+
+// Token source for domain-wide delegation without a private key. The JWT asserting the delegated subject is
+// signed by the IAM Credentials signJwt API as the service account, using Application Default Credentials.
+type signJWTTokenSource struct {
+	ctx            context.Context
+	credentials    *iamcredentials.Service
+	client         *http.Client
+	tokenURL       string
+	serviceAccount string
+	subject        string
+	scopes         []string
+	// Timeout of signing and exchanging the JWT for an access token together
+	timeout time.Duration
+}
+
+// Build and returns an Admin SDK Directory service object authorized with Application Default Credentials
+// (e.g. GKE Workload Identity) that act on behalf of the given user. Minting an access token is given the timeout.
+func getAdminServiceWithWorkloadIdentity(ctx context.Context, serviceAccount, gcpAdminUser string, timeout time.Duration) (*admin.Service, error) {
+	if serviceAccount == "" {
+		email, err := metadata.Email("default")
+		if err != nil {
+			return nil, fmt.Errorf("unable to get service account from metadata server: %s", err)
+		}
+		serviceAccount = email
+	}
+
+	credentials, err := iamcredentials.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create IAM credentials client: %s", err)
+	}
+
+	tokenSource := &signJWTTokenSource{
+		ctx:            ctx,
+		credentials:    credentials,
+		client:         http.DefaultClient,
+		tokenURL:       GoogleTokenURL,
+		serviceAccount: serviceAccount,
+		subject:        gcpAdminUser,
+		scopes:         []string{admin.AdminDirectoryGroupMemberReadonlyScope, admin.AdminDirectoryGroupReadonlyScope},
+		timeout:        timeout,
+	}
+
+	service, err := admin.NewService(ctx, option.WithTokenSource(oauth2.ReuseTokenSource(nil, tokenSource)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve Google Admin Client: %s", err)
+	}
+
+	return service, nil
+}
+
+func (s *signJWTTokenSource) Token() (*oauth2.Token, error) {
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   s.serviceAccount,
+		"sub":   s.subject,
+		"scope": strings.Join(s.scopes, " "),
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(s.ctx, s.timeout)
+	defer cancel()
+
+	name := fmt.Sprintf("projects/-/serviceAccounts/%s", s.serviceAccount)
+	signed, err := s.credentials.Projects.ServiceAccounts.SignJwt(name, &iamcredentials.SignJwtRequest{Payload: string(claims)}).Context(ctx).Do()
+	if err != nil {
+		promErrors.WithLabelValues("sign-jwt").Inc()
+		return nil, fmt.Errorf("unable to sign jwt as %s: %s", s.serviceAccount, err)
+	}
+
+	return s.exchange(ctx, signed.SignedJwt)
+}
+
+// Exchanges the signed JWT for an access token
+func (s *signJWTTokenSource) exchange(ctx context.Context, assertion string) (*oauth2.Token, error) {
+	form := url.Values{
+		"grant_type": {jwtBearerGrant},
+		"assertion":  {assertion},
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create access token request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		promErrors.WithLabelValues("exchange-jwt").Inc()
+		return nil, fmt.Errorf("unable to exchange jwt for access token: %s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		promErrors.WithLabelValues("exchange-jwt").Inc()
+		return nil, fmt.Errorf("unable to exchange jwt for access token: %s", response.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("unable to decode access token response: %s", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: token.AccessToken,
+		TokenType:   token.TokenType,
+		Expiry:      time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/iamcredentials/v1"
+	"google.golang.org/api/option"
+)
+
+func TestSignJWTTokenSource(t *testing.T) {
+	ctx := context.Background()
+	var claims map[string]interface{}
+	var signedAs string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":signJwt"):
+			signedAs = strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":signJwt")
+			var request iamcredentials.SignJwtRequest
+			json.NewDecoder(r.Body).Decode(&request)
+			json.Unmarshal([]byte(request.Payload), &claims)
+			json.NewEncoder(w).Encode(iamcredentials.SignJwtResponse{SignedJwt: "signed-jwt"})
+		case r.URL.Path == "/token":
+			r.ParseForm()
+			if r.Form.Get("grant_type") != jwtBearerGrant || r.Form.Get("assertion") != "signed-jwt" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"access_token": "access-token", "token_type": "Bearer", "expires_in": 3600}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	credentials, err := iamcredentials.NewService(ctx, option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	assert.NoError(t, err)
+
+	tokenSource := &signJWTTokenSource{
+		ctx:            ctx,
+		credentials:    credentials,
+		client:         server.Client(),
+		tokenURL:       server.URL + "/token",
+		serviceAccount: "rbac-sync@project.iam.gserviceaccount.com",
+		subject:        "admin@acme.no",
+		scopes:         []string{"scope-a", "scope-b"},
+	}
+
+	token, err := tokenSource.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expiry, time.Minute)
+
+	assert.Equal(t, "projects/-/serviceAccounts/rbac-sync@project.iam.gserviceaccount.com", signedAs)
+	assert.Equal(t, "rbac-sync@project.iam.gserviceaccount.com", claims["iss"])
+	assert.Equal(t, "admin@acme.no", claims["sub"])
+	assert.Equal(t, "scope-a scope-b", claims["scope"])
+	assert.Equal(t, server.URL+"/token", claims["aud"])
+}
+
+func TestSignJWTTokenSourceTimesOut(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(iamcredentials.SignJwtResponse{SignedJwt: "signed-jwt"})
+	}))
+	defer server.Close()
+
+	credentials, err := iamcredentials.NewService(ctx, option.WithEndpoint(server.URL+"/"), option.WithHTTPClient(server.Client()))
+	assert.NoError(t, err)
+
+	tokenSource := &signJWTTokenSource{
+		ctx:            ctx,
+		credentials:    credentials,
+		client:         server.Client(),
+		tokenURL:       server.URL + "/token",
+		serviceAccount: "rbac-sync@project.iam.gserviceaccount.com",
+		subject:        "admin@acme.no",
+		timeout:        10 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err = tokenSource.Token()
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}